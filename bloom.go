@@ -0,0 +1,91 @@
+package cch
+
+import (
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+// bloomFilter is a concurrent-safe bloom filter over cache keys. It never
+// reports a present key as absent, but may report an absent key as
+// present. Keys cannot be removed from it.
+type bloomFilter struct {
+	bits    []atomic.Uint64
+	m       uint64
+	k       uint64
+	skipped atomic.Uint64
+}
+
+// WithBloomFilter puts a bloom filter in front of Get so lookups for keys
+// that were never added return a miss without touching the underlying map.
+// The filter is sized for expectedKeys at the given false positive rate;
+// false positives simply fall through to a normal lookup. Removing a key
+// does not clear it from the filter, so removed keys are always looked up.
+func WithBloomFilter(expectedKeys int, falsePositiveRate float64) CacheOption {
+	return func(c *Cache) {
+		c.bloom = newBloomFilter(expectedKeys, falsePositiveRate)
+	}
+}
+
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]atomic.Uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		word, mask := &b.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := word.Load()
+			if old&mask != 0 || word.CompareAndSwap(old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+// mayContain reports false only if key was never added
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64].Load()&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum & 0xffffffff, sum>>32 | 1
+}
+
+// remember records key in the cache's bloom filter, if any. It must be
+// called before the key is stored so the filter never hides a present key.
+func (c *Cache) remember(key string) {
+	if c.bloom != nil {
+		c.bloom.add(key)
+	}
+}
@@ -1,15 +1,189 @@
 package cch
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
 )
 
 type Cache struct {
 	namespace string
-	storage   *sync.Map
+	storage   *entryMap
+	mu        sync.RWMutex
 	expire    time.Time
+	ttl       time.Duration
+	index     *expiryIndex
+	logger    *slog.Logger
+	clock     Clock
+	limiter   *tokenBucket
+	subs      subscribers
+	auditHook atomic.Pointer[func(op, key string)]
+	draining  atomic.Bool
+	stats     *cacheStats
+	events    *eventLog
+	bloom     *bloomFilter
+	equal     func(a, b any) bool
+	encode    func(any) (any, error)
+	decode    func(any) (any, error)
+	sizeHint  int
+	opts      []CacheOption
+	refreshes flightGroup
+
+	maxValueBytes int64
+	rejectNil     bool
+	defaultTTL    *atomic.Int64 // shared with the store
+	labels        map[string]string
+	pressureLimit atomic.Uint64
+}
+
+// CacheOption configures a single Cache
+type CacheOption func(*Cache)
+
+// WithEquality sets the comparator CompareAndSwap and EqualValues use to
+// decide whether two values are equal. The default is reflect.DeepEqual.
+func WithEquality(fn func(a, b any) bool) CacheOption {
+	return func(c *Cache) {
+		c.equal = fn
+	}
+}
+
+// entry is a cached value with an optional per-key deadline. A zero
+// expires means the key lives as long as its cache. lastAccess holds the
+// time of the last read or write in Unix nanoseconds.
+type entry struct {
+	value      any
+	expires    time.Time
+	written    time.Time
+	version    uint64
+	lastAccess atomic.Int64
+}
+
+// versions numbers entries as they are created. Every write stores a new
+// entry, so a key's version increases with each write to it.
+var versions atomic.Uint64
+
+// newEntry returns an entry for value. written is when the value was
+// stored; an entry rebuilt from another without a new value keeps the
+// original's written time.
+func newEntry(value any, expires, written, accessed time.Time) *entry {
+	e := &entry{value: value, expires: expires, written: written, version: versions.Add(1)}
+	e.touch(accessed)
+	return e
+}
+
+// touch records an access at t
+func (e *entry) touch(t time.Time) {
+	e.lastAccess.Store(t.UnixNano())
+}
+
+// accessed returns the time of the last read or write
+func (e *entry) accessed() time.Time {
+	return time.Unix(0, e.lastAccess.Load())
+}
+
+// expired reports whether the entry's deadline has passed
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !e.expires.After(now)
+}
+
+// Entry is a key/value pair in a cache along with its per-key deadline.
+// ExpiresAt is the zero time when the key has no deadline of its own.
+type Entry struct {
+	Key       string
+	Value     any
+	ExpiresAt time.Time
+}
+
+// EntryMeta is a cached value with its per-key deadline. Stale is true once
+// the deadline has passed.
+type EntryMeta struct {
+	Value     any
+	ExpiresAt time.Time
+	Stale     bool
+}
+
+// Stats reports a cache's hit and miss counts. Enabled is false when the
+// store was created without WithStats, in which case no counting is done
+// and the counts are always zero.
+type Stats struct {
+	Enabled bool
+	Hits    uint64
+	Misses  uint64
+}
+
+type cacheStats struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// ErrRateLimited is returned when a cache rejects a write because its
+// write rate limit has been exceeded
+var ErrRateLimited = errors.New("write rate limit exceeded")
+
+// ErrValueTooLarge is returned when a value exceeds the cache's maximum
+// value size
+var ErrValueTooLarge = errors.New("value too large")
+
+// ErrNilValue is returned when writing a nil value to a cache in a store
+// created with WithRejectNil
+var ErrNilValue = errors.New("nil value")
+
+// ErrDraining is returned when writing to a cache that is being drained
+var ErrDraining = errors.New("cache is draining")
+
+// OnExists controls how AddWith handles a key that already exists
+type OnExists int
+
+const (
+	// Reject returns an error if the key already exists
+	Reject OnExists = iota
+	// Overwrite replaces the existing value
+	Overwrite
+	// Keep leaves the existing value in place
+	Keep
+)
+
+// ConflictPolicy controls how Merge handles a key present in both caches
+type ConflictPolicy int
+
+const (
+	// MergeSkip keeps the existing value
+	MergeSkip ConflictPolicy = iota
+	// MergeOverwrite replaces the existing value with the other cache's
+	MergeOverwrite
+	// MergeError fails the merge, without applying anything, if any key
+	// conflicts
+	MergeError
+)
+
+// WithValueTransform stores values in a transformed form, such as
+// compressed or encrypted. Writes run encode before storing and reads run
+// decode before returning, propagating their errors; Get, which has no
+// error result, reports a value that fails to decode as missing. Every
+// other accessor, including Map, Entries, MapWithMeta, Dump, SizeByType,
+// clones, snapshots and the store's exports, decodes values too.
+func WithValueTransform(encode, decode func(any) (any, error)) CacheOption {
+	return func(c *Cache) {
+		c.encode = encode
+		c.decode = decode
+	}
+}
+
+// WithCapacityHint tells the cache how many entries it is expected to
+// hold. A sync.Map cannot be preallocated, so the hint sizes the maps that
+// Map and MapWithMeta build rather than the cache's own storage.
+func WithCapacityHint(entries int) CacheOption {
+	return func(c *Cache) {
+		c.sizeHint = entries
+	}
 }
 
 // Add adds a new item to the cache
@@ -17,10 +191,225 @@ func (c *Cache) Add(key string, value any) error {
 	if c == nil {
 		return nilCache(c.namespace)
 	}
+	return c.AddWith(key, value, Reject)
+}
+
+// AddWith adds a new item to the cache, handling an existing key according
+// to onExists
+func (c *Cache) AddWith(key string, value any, onExists OnExists) error {
+	if c == nil {
+		return nilCache("")
+	}
+	c.audit("add", key)
+	value, err := c.prepare(value)
+	if err != nil {
+		return err
+	}
+	now := c.now()
+	switch onExists {
+	case Reject:
+		return c.add(key, newEntry(value, c.defaultDeadline(now), now, now))
+	case Overwrite:
+		if _, exists := c.live(key); exists {
+			c.storage.Store(key, newEntry(value, c.defaultDeadline(now), now, now))
+			c.publish(key, value)
+			return nil
+		}
+		return c.add(key, newEntry(value, c.defaultDeadline(now), now, now))
+	case Keep:
+		if _, exists := c.live(key); exists {
+			return nil
+		}
+		return c.add(key, newEntry(value, c.defaultDeadline(now), now, now))
+	default:
+		return fmt.Errorf("unknown OnExists behavior: %d", onExists)
+	}
+}
+
+// AddWithTTL adds a new item to the cache that expires after ttl
+func (c *Cache) AddWithTTL(key string, value any, ttl time.Duration) error {
+	if c == nil {
+		return nilCache("")
+	}
+	c.audit("add", key)
+	value, err := c.prepare(value)
+	if err != nil {
+		return err
+	}
+	now := c.now()
+	return c.add(key, newEntry(value, now.Add(ttl), now, now))
+}
+
+// ItemWithTTL is a value to store with its own time to live. A zero TTL
+// uses the store's default TTL, if any.
+type ItemWithTTL struct {
+	Value any
+	TTL   time.Duration
+}
+
+// SetMany stores every item, overwriting existing keys, each with a
+// deadline of its own TTL from now. Every value is validated before any is
+// written; failures storing individual keys are joined into the returned
+// error.
+func (c *Cache) SetMany(items map[string]ItemWithTTL) error {
+	if c == nil {
+		return nilCache("")
+	}
+	stored := make(map[string]any, len(items))
+	for key, item := range items {
+		value, err := c.prepare(item.Value)
+		if err != nil {
+			return err
+		}
+		stored[key] = value
+	}
+
+	now := c.now()
+	var errs []error
+	for key, item := range items {
+		c.audit("add", key)
+		expires := c.defaultDeadline(now)
+		if item.TTL != 0 {
+			expires = now.Add(item.TTL)
+		}
+		e := newEntry(stored[key], expires, now, now)
+		if _, exists := c.storage.Load(key); exists {
+			c.storage.Store(key, e)
+			c.publish(key, e.value)
+			continue
+		}
+		if err := c.add(key, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// defaultDeadline returns the deadline for a key written now without an
+// explicit TTL, or the zero time if the store has no default TTL
+func (c *Cache) defaultDeadline(now time.Time) time.Time {
+	if c.defaultTTL == nil {
+		return time.Time{}
+	}
+	if d := time.Duration(c.defaultTTL.Load()); d > 0 {
+		return now.Add(d)
+	}
+	return time.Time{}
+}
+
+// validate checks that the cache accepts writes and that value is within
+// the cache's limits
+func (c *Cache) validate(value any) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	if c.rejectNil && isNil(value) {
+		return ErrNilValue
+	}
+	if c.maxValueBytes > 0 && approxBytes(value) > c.maxValueBytes {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// prepare validates value and returns it in the form it is stored in
+func (c *Cache) prepare(value any) (any, error) {
+	if err := c.validate(value); err != nil {
+		return nil, err
+	}
+	return c.encodeValue(value)
+}
+
+// encodeValue returns value in the form the cache stores, without
+// validating it
+func (c *Cache) encodeValue(value any) (any, error) {
+	if c.encode == nil {
+		return value, nil
+	}
+	return c.encode(value)
+}
+
+// load returns a stored value in the form callers see
+func (c *Cache) load(stored any) (any, error) {
+	if c.decode == nil {
+		return stored, nil
+	}
+	return c.decode(stored)
+}
+
+// isNil reports whether value is a nil interface or a nil pointer
+func isNil(value any) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
+
+// live returns the entry stored at key, treating one whose deadline has
+// passed as missing so writes behave the same as Get
+func (c *Cache) live(key string) (any, bool) {
+	value, exists := c.storage.Load(key)
+	if !exists || value.(*entry).expired(c.now()) {
+		return nil, false
+	}
+	return value, true
+}
+
+// dropExpired removes the entry at key if its deadline has passed, so a
+// write can take the key's place
+func (c *Cache) dropExpired(key string) {
+	if value, exists := c.storage.Load(key); exists && value.(*entry).expired(c.now()) {
+		c.storage.CompareAndDelete(key, value)
+	}
+}
+
+func (c *Cache) add(key string, e *entry) error {
+	c.dropExpired(key)
 	if _, exists := c.storage.Load(key); exists {
 		return fmt.Errorf("key already exists: %s", key)
 	}
-	c.storage.Store(key, value)
+	if c.limiter != nil && !c.limiter.allow() {
+		return ErrRateLimited
+	}
+	c.remember(key)
+	if _, loaded := c.storage.LoadOrStore(key, e); loaded {
+		return fmt.Errorf("key already exists: %s", key)
+	}
+	c.publish(key, e.value)
+	return nil
+}
+
+// SetAuditHook registers fn to be called with the operation name ("get",
+// "add", "remove" or "replace") and key on every Get, Add, AddWith,
+// AddWithTTL, Remove and Replace. The hook is called without any cache lock
+// held. Pass nil to remove it.
+func (c *Cache) SetAuditHook(fn func(op, key string)) {
+	if c == nil {
+		return
+	}
+	if fn == nil {
+		c.auditHook.Store(nil)
+		return
+	}
+	c.auditHook.Store(&fn)
+}
+
+// audit reports an operation to the event log and audit hook, if any
+func (c *Cache) audit(op, key string) {
+	if c.events != nil {
+		c.events.record(Event{Op: op, Key: key, Time: c.now()})
+	}
+	if fn := c.auditHook.Load(); fn != nil {
+		(*fn)(op, key)
+	}
+}
+
+// writable returns ErrDraining once the cache has started draining
+func (c *Cache) writable() error {
+	if c.draining.Load() {
+		return ErrDraining
+	}
 	return nil
 }
 
@@ -29,6 +418,7 @@ func (c *Cache) Remove(key string) error {
 	if c == nil {
 		return nilCache(c.namespace)
 	}
+	c.audit("remove", key)
 	if _, exists := c.storage.Load(key); !exists {
 		return fmt.Errorf("key does not exist: %s", key)
 	}
@@ -36,57 +426,1164 @@ func (c *Cache) Remove(key string) error {
 	return nil
 }
 
-// Get gets an item from the cache by key
+// RemoveMany removes every given key that exists in the cache and returns
+// how many were removed. Missing keys are ignored.
+func (c *Cache) RemoveMany(keys []string) int {
+	if c == nil {
+		return 0
+	}
+	removed := 0
+	for _, key := range keys {
+		c.audit("remove", key)
+		if _, loaded := c.storage.LoadAndDelete(key); loaded {
+			removed++
+		}
+	}
+	return removed
+}
+
+// SetMemoryPressureThreshold makes the store's sweep shed this cache's
+// least recently used entries while the process heap, as reported by
+// runtime.MemStats.HeapAlloc, is above heapBytes. Memory is only returned
+// once the garbage collector runs, so each sweep evicts entries whose
+// estimated size covers the excess rather than waiting for HeapAlloc to
+// drop. A sweep that has any threshold to check calls runtime.ReadMemStats,
+// which briefly stops the world. A heapBytes of zero disables shedding.
+func (c *Cache) SetMemoryPressureThreshold(heapBytes uint64) {
+	if c == nil {
+		return
+	}
+	c.pressureLimit.Store(heapBytes)
+}
+
+// shed evicts least recently used entries whose estimated size covers the
+// amount by which heapAlloc exceeds the cache's threshold, and returns how
+// many were evicted
+func (c *Cache) shed(heapAlloc uint64) int {
+	limit := c.pressureLimit.Load()
+	if limit == 0 || heapAlloc <= limit {
+		return 0
+	}
+	type candidate struct {
+		key      any
+		e        *entry
+		accessed int64
+	}
+	var all []candidate
+	c.storage.Range(func(key, value any) bool {
+		e := value.(*entry)
+		all = append(all, candidate{key: key, e: e, accessed: e.lastAccess.Load()})
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].accessed < all[j].accessed
+	})
+
+	excess := int64(heapAlloc - limit)
+	evicted := 0
+	for _, cand := range all {
+		if excess <= 0 {
+			break
+		}
+		if c.storage.CompareAndDelete(cand.key, cand.e) {
+			c.audit("remove", cand.key.(string))
+			excess -= int64(len(cand.key.(string))) + approxBytes(cand.e.value)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// RemoveExpired deletes every key whose deadline has passed and returns
+// how many were removed. Expired keys are otherwise only removed when they
+// are read, so this lets a cache clean itself up without the store's
+// janitor. There is no eviction callback to notify.
+func (c *Cache) RemoveExpired() int {
+	if c == nil {
+		return 0
+	}
+	now := c.now()
+	removed := 0
+	c.storage.Range(func(key, value any) bool {
+		if value.(*entry).expired(now) && c.storage.CompareAndDelete(key, value) {
+			c.audit("remove", key.(string))
+			removed++
+		}
+		return true
+	})
+	return removed
+}
+
+// TrimTo removes all but the n most recently accessed entries and returns
+// how many were removed. It does nothing if the cache holds n entries or
+// fewer.
+func (c *Cache) TrimTo(n int) int {
+	if c == nil {
+		return 0
+	}
+	type candidate struct {
+		key      any
+		e        *entry
+		accessed int64
+	}
+	var all []candidate
+	c.storage.Range(func(key, value any) bool {
+		e := value.(*entry)
+		all = append(all, candidate{key: key, e: e, accessed: e.lastAccess.Load()})
+		return true
+	})
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(all) {
+		return 0
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].accessed > all[j].accessed
+	})
+	removed := 0
+	for _, cand := range all[n:] {
+		if c.storage.CompareAndDelete(cand.key, cand.e) {
+			c.audit("remove", cand.key.(string))
+			removed++
+		}
+	}
+	return removed
+}
+
+// Get gets an item from the cache by key. A key whose deadline has passed
+// is reported as missing and removed.
 func (c *Cache) Get(key string) (any, bool) {
 	if c == nil {
 		return nil, false
 	}
+	c.audit("get", key)
+	if c.bloom != nil && !c.bloom.mayContain(key) {
+		c.bloom.skipped.Add(1)
+		if c.stats != nil {
+			c.stats.misses.Add(1)
+		}
+		return nil, false
+	}
 	value, exists := c.storage.Load(key)
 	if !exists {
+		if c.stats != nil {
+			c.stats.misses.Add(1)
+		}
 		return nil, false
 	}
-	return value, true
+	e := value.(*entry)
+	now := c.now()
+	if e.expired(now) {
+		c.storage.CompareAndDelete(key, value)
+		if c.stats != nil {
+			c.stats.misses.Add(1)
+		}
+		return nil, false
+	}
+	decoded, err := c.load(e.value)
+	if err != nil {
+		logAt(c.logger, slog.LevelError, "decode failed", "namespace", c.namespace, "key", key, "error", err)
+		if c.stats != nil {
+			c.stats.misses.Add(1)
+		}
+		return nil, false
+	}
+	if c.stats != nil {
+		c.stats.hits.Add(1)
+	}
+	e.touch(now)
+	return decoded, true
+}
+
+// Result is the outcome of an AsyncGet
+type Result struct {
+	Value any
+	Err   error
+}
+
+// AsyncGet looks up key and returns a channel that delivers a single
+// Result and is then closed. A miss is delivered as an error. The channel
+// is buffered, so callers may fan out many lookups before reading any.
+func (c *Cache) AsyncGet(key string) <-chan Result {
+	ch := make(chan Result, 1)
+	if c == nil {
+		ch <- Result{Err: nilCache("")}
+	} else if value, exists := c.Get(key); exists {
+		ch <- Result{Value: value}
+	} else {
+		ch <- Result{Err: keyNotExists(key, c.namespace)}
+	}
+	close(ch)
+	return ch
+}
+
+// GetStaleWhileRevalidate returns the value at key, using loader to keep it
+// up to date. A value written less than fresh ago is returned as is. One
+// older than fresh but younger than stale is returned immediately while a
+// single background call to loader replaces it. Only a missing value, or
+// one older than stale, waits for loader. Loaded values are stored with a
+// TTL of stale; errors from background refreshes are logged and the old
+// value stays in place.
+func (c *Cache) GetStaleWhileRevalidate(key string, loader func() (any, error), fresh, stale time.Duration) (any, error) {
+	if c == nil {
+		return nil, nilCache("")
+	}
+	c.audit("get", key)
+	if value, age, ok := c.aged(key); ok {
+		if age < fresh {
+			return value, nil
+		}
+		if age < stale {
+			go func() {
+				if _, err := c.revalidate(key, loader, fresh, stale); err != nil {
+					logAt(c.logger, slog.LevelError, "refresh failed", "namespace", c.namespace, "key", key, "error", err)
+				}
+			}()
+			return value, nil
+		}
+	}
+	return c.revalidate(key, loader, fresh, stale)
+}
+
+// revalidate calls loader and stores its result unless another call has
+// refreshed key within fresh. Concurrent calls for the same key share one
+// loader call.
+func (c *Cache) revalidate(key string, loader func() (any, error), fresh, stale time.Duration) (any, error) {
+	return c.refreshes.do(key, func() (any, error) {
+		if value, age, ok := c.aged(key); ok && age < fresh {
+			return value, nil
+		}
+		value, err := loader()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.SetMany(map[string]ItemWithTTL{key: {Value: value, TTL: stale}}); err != nil {
+			return nil, err
+		}
+		return value, nil
+	})
+}
+
+// aged returns the unexpired value at key and how long ago it was written
+func (c *Cache) aged(key string) (any, time.Duration, bool) {
+	value, exists := c.storage.Load(key)
+	if !exists {
+		return nil, 0, false
+	}
+	e := value.(*entry)
+	now := c.now()
+	if e.expired(now) {
+		return nil, 0, false
+	}
+	decoded, err := c.load(e.value)
+	if err != nil {
+		return nil, 0, false
+	}
+	return decoded, now.Sub(e.written), true
+}
+
+// warmWorkers bounds how many loader calls Warm makes at once
+const warmWorkers = 8
+
+// Warm preloads keys by calling loader for each of them, up to eight at a
+// time, and stores every value it returns with the given ttl, overwriting
+// existing keys. Keys whose loader fails are skipped; their errors are
+// joined into the returned error.
+func (c *Cache) Warm(keys []string, loader func(key string) (any, error), ttl time.Duration) error {
+	if c == nil {
+		return nilCache("")
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, warmWorkers)
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			value, err := loader(key)
+			if err == nil {
+				err = c.SetMany(map[string]ItemWithTTL{key: {Value: value, TTL: ttl}})
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("warm %s: %w", key, err))
+				mu.Unlock()
+			}
+		}(key)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// GetMulti gets the values for keys in a single pass over the cache, which
+// can be faster than calling Get for each key when many keys are wanted.
+// Missing and expired keys, and values that fail to decode, are absent from
+// the result.
+func (c *Cache) GetMulti(keys ...string) map[string]any {
+	if c == nil {
+		return nil
+	}
+	wanted := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		c.audit("get", key)
+		wanted[key] = struct{}{}
+	}
+
+	now := c.now()
+	result := make(map[string]any, len(wanted))
+	seen := 0
+	c.storage.Range(func(key, value any) bool {
+		if _, ok := wanted[key.(string)]; ok {
+			seen++
+			e := value.(*entry)
+			if e.expired(now) {
+				c.storage.CompareAndDelete(key, value)
+				return seen < len(wanted)
+			}
+			decoded, err := c.load(e.value)
+			if err != nil {
+				logAt(c.logger, slog.LevelError, "decode failed", "namespace", c.namespace, "key", key, "error", err)
+				return seen < len(wanted)
+			}
+			e.touch(now)
+			result[key.(string)] = decoded
+		}
+		return seen < len(wanted)
+	})
+	if c.stats != nil {
+		c.stats.hits.Add(uint64(len(result)))
+		c.stats.misses.Add(uint64(len(wanted) - len(result)))
+	}
+	return result
+}
+
+// GetWithVersion gets the value at key along with its version. The version
+// changes on every write to the key and can be passed to ReplaceIfVersion.
+func (c *Cache) GetWithVersion(key string) (any, uint64, error) {
+	if c == nil {
+		return nil, 0, nilCache("")
+	}
+	c.audit("get", key)
+	value, exists := c.live(key)
+	if !exists {
+		return nil, 0, keyNotExists(key, c.namespace)
+	}
+	e := value.(*entry)
+	decoded, err := c.load(e.value)
+	if err != nil {
+		return nil, 0, err
+	}
+	e.touch(c.now())
+	return decoded, e.version, nil
+}
+
+// ReplaceIfVersion stores value at key if the key's version is still
+// expected, and reports whether it did. The key keeps its deadline. It
+// returns an error if the key does not exist.
+func (c *Cache) ReplaceIfVersion(key string, value any, expected uint64) (bool, error) {
+	if c == nil {
+		return false, nilCache("")
+	}
+	c.audit("replace", key)
+	value, err := c.prepare(value)
+	if err != nil {
+		return false, err
+	}
+	current, exists := c.live(key)
+	if !exists {
+		return false, keyNotExists(key, c.namespace)
+	}
+	e := current.(*entry)
+	if e.version != expected {
+		return false, nil
+	}
+	now := c.now()
+	if !c.storage.CompareAndSwap(key, current, newEntry(value, e.expires, now, now)) {
+		return false, nil
+	}
+	c.publish(key, value)
+	return true, nil
+}
+
+// Peek reads the value at key without counting it as a use: it does not
+// update the key's last access time, hit/miss stats, event log or audit
+// hook. Like Get, it reports a key whose deadline has passed as missing,
+// but leaves removing it to Get or a sweep.
+func (c *Cache) Peek(key string) (any, bool) {
+	if c == nil {
+		return nil, false
+	}
+	value, exists := c.storage.Load(key)
+	if !exists || value.(*entry).expired(c.now()) {
+		return nil, false
+	}
+	decoded, err := c.load(value.(*entry).value)
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
 }
 
-// Replace removes the value and replaces it with a new one
+// Replace removes the value and replaces it with a new one. The key keeps
+// its existing deadline, as with ReplaceKeepTTL.
 func (c *Cache) Replace(key string, newValue any) error {
+	return c.replace(key, newValue, false)
+}
+
+// ReplaceKeepTTL replaces the value at key, keeping the key's existing
+// deadline
+func (c *Cache) ReplaceKeepTTL(key string, newValue any) error {
+	return c.replace(key, newValue, false)
+}
+
+// ReplaceResetTTL replaces the value at key and restarts its deadline as if
+// the key had just been added: from the store's default TTL if one is set,
+// otherwise the key falls back to the cache's expiration
+func (c *Cache) ReplaceResetTTL(key string, newValue any) error {
+	return c.replace(key, newValue, true)
+}
+
+// replace stores newValue at an existing key, either keeping its deadline
+// or resetting it to the default
+func (c *Cache) replace(key string, newValue any, resetTTL bool) error {
 	if c == nil {
-		return nilCache(c.namespace)
+		return nilCache("")
 	}
-	if _, exists := c.storage.Load(key); !exists {
+	c.audit("replace", key)
+	newValue, err := c.prepare(newValue)
+	if err != nil {
+		return err
+	}
+	value, exists := c.live(key)
+	if !exists {
 		return keyNotExists(key, c.namespace)
 	}
-	if err := c.Remove(key); err != nil {
-		return err
+	now := c.now()
+	expires := value.(*entry).expires
+	if resetTTL {
+		expires = c.defaultDeadline(now)
+	}
+	c.storage.Store(key, newEntry(newValue, expires, now, now))
+	c.publish(key, newValue)
+	return nil
+}
+
+// BatchReplace replaces the value of every key in updates that exists,
+// keeping each key's deadline as Replace does, and never inserts new keys.
+// It returns how many were replaced and the sorted keys that were missing or
+// expired. Values that fail validation or encoding are left unchanged and
+// their errors joined into err; a draining cache replaces nothing and
+// returns ErrDraining.
+func (c *Cache) BatchReplace(updates map[string]any) (applied int, missing []string, err error) {
+	if c == nil {
+		return 0, nil, nilCache("")
+	}
+	if err := c.writable(); err != nil {
+		return 0, nil, err
+	}
+	keys := make([]string, 0, len(updates))
+	for key := range updates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := c.now()
+	var errs []error
+	for _, key := range keys {
+		c.audit("replace", key)
+		stored, err := c.prepare(updates[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replacing %s: %w", key, err))
+			continue
+		}
+		for {
+			old, exists := c.storage.Load(key)
+			if !exists || old.(*entry).expired(now) {
+				missing = append(missing, key)
+				break
+			}
+			if c.storage.CompareAndSwap(key, old, newEntry(stored, old.(*entry).expires, now, now)) {
+				c.publish(key, stored)
+				applied++
+				break
+			}
+		}
+	}
+	return applied, missing, errors.Join(errs...)
+}
+
+// LastAccess returns when the key was last read by Get or written
+func (c *Cache) LastAccess(key string) (time.Time, error) {
+	if c == nil {
+		return time.Time{}, nilCache("")
 	}
-	if err := c.Add(key, newValue); err != nil {
+	value, exists := c.live(key)
+	if !exists {
+		return time.Time{}, keyNotExists(key, c.namespace)
+	}
+	return value.(*entry).accessed(), nil
+}
+
+// ReplaceFunc atomically replaces the value at key with the result of
+// calling fn on the current value. fn may be called more than once if
+// another writer changes the key concurrently, so it should not have side
+// effects. It returns an error if the key does not exist or fn fails.
+func (c *Cache) ReplaceFunc(key string, fn func(old any) (any, error)) error {
+	if c == nil {
+		return nilCache("")
+	}
+	c.audit("replace", key)
+	return c.update(key, func(e *entry) (*entry, error) {
+		old, err := c.load(e.value)
+		if err != nil {
+			return nil, err
+		}
+		value, err := fn(old)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = c.prepare(value); err != nil {
+			return nil, err
+		}
+		now := c.now()
+		return newEntry(value, e.expires, now, now), nil
+	})
+}
+
+// Swap replaces the value for an existing key and returns the previous value
+func (c *Cache) Swap(key string, value any) (any, error) {
+	if c == nil {
+		return nil, nilCache("")
+	}
+	value, err := c.prepare(value)
+	if err != nil {
+		return nil, err
+	}
+	var old *entry
+	err = c.update(key, func(e *entry) (*entry, error) {
+		old = e
+		now := c.now()
+		return newEntry(value, e.expires, now, now), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.load(old.value)
+}
+
+// RenameKey moves the value at oldKey to newKey, keeping its deadline. The
+// value is stored under newKey before oldKey is removed, so readers always
+// find it under at least one of the two keys.
+func (c *Cache) RenameKey(oldKey, newKey string) error {
+	if c == nil {
+		return nilCache("")
+	}
+	if err := c.writable(); err != nil {
 		return err
 	}
+	current, exists := c.live(oldKey)
+	if !exists {
+		return keyNotExists(oldKey, c.namespace)
+	}
+	c.dropExpired(newKey)
+	c.remember(newKey)
+	if _, loaded := c.storage.LoadOrStore(newKey, current); loaded {
+		return fmt.Errorf("key already exists: %s", newKey)
+	}
+	if !c.storage.CompareAndDelete(oldKey, current) {
+		c.storage.CompareAndDelete(newKey, current)
+		return fmt.Errorf("key changed during rename: %s", oldKey)
+	}
+	c.publish(newKey, current.(*entry).value)
 	return nil
 }
 
-// Purge clears the cache
+// IncrementFloat atomically adds delta to the float64 stored at key and
+// returns the new value. It returns an error if the key does not exist or
+// its value is not a float64.
+func (c *Cache) IncrementFloat(key string, delta float64) (float64, error) {
+	if c == nil {
+		return 0, nilCache("")
+	}
+	var sum float64
+	err := c.update(key, func(e *entry) (*entry, error) {
+		current, err := c.load(e.value)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := current.(float64)
+		if !ok {
+			return nil, fmt.Errorf("value for key %s is %T, not float64", key, current)
+		}
+		sum = f + delta
+		stored, err := c.prepare(sum)
+		if err != nil {
+			return nil, err
+		}
+		now := c.now()
+		return newEntry(stored, e.expires, now, now), nil
+	})
+	return sum, err
+}
+
+// SetIfGreater stores value at key if the key is absent or value is greater
+// than the int64 currently stored, and reports whether it stored it. It
+// returns an error if the current value is not an int64.
+func (c *Cache) SetIfGreater(key string, value int64) (bool, error) {
+	if c == nil {
+		return false, nilCache("")
+	}
+	stored, err := c.prepare(value)
+	if err != nil {
+		return false, err
+	}
+	for {
+		current, exists := c.storage.Load(key)
+		if exists && current.(*entry).expired(c.now()) {
+			c.storage.CompareAndDelete(key, current)
+			continue
+		}
+		if !exists {
+			c.remember(key)
+			now := c.now()
+			if _, loaded := c.storage.LoadOrStore(key, newEntry(stored, c.defaultDeadline(now), now, now)); loaded {
+				continue
+			}
+			c.publish(key, stored)
+			return true, nil
+		}
+		e := current.(*entry)
+		decoded, err := c.load(e.value)
+		if err != nil {
+			return false, err
+		}
+		n, ok := decoded.(int64)
+		if !ok {
+			return false, fmt.Errorf("value for key %s is %T, not int64", key, decoded)
+		}
+		if value <= n {
+			return false, nil
+		}
+		now := c.now()
+		if c.storage.CompareAndSwap(key, current, newEntry(stored, e.expires, now, now)) {
+			c.publish(key, stored)
+			return true, nil
+		}
+	}
+}
+
+// CompareAndSwap stores newValue at key if the current value equals old
+// under the cache's comparator, and reports whether it did. The key keeps
+// its existing deadline. It returns an error if the key does not exist.
+func (c *Cache) CompareAndSwap(key string, old, newValue any) (bool, error) {
+	if c == nil {
+		return false, nilCache("")
+	}
+	c.audit("replace", key)
+	newValue, err := c.prepare(newValue)
+	if err != nil {
+		return false, err
+	}
+	for {
+		current, exists := c.live(key)
+		if !exists {
+			return false, keyNotExists(key, c.namespace)
+		}
+		e := current.(*entry)
+		decoded, err := c.load(e.value)
+		if err != nil {
+			return false, err
+		}
+		if !c.equals(decoded, old) {
+			return false, nil
+		}
+		now := c.now()
+		if c.storage.CompareAndSwap(key, current, newEntry(newValue, e.expires, now, now)) {
+			c.publish(key, newValue)
+			return true, nil
+		}
+	}
+}
+
+// equals compares a and b with the cache's comparator
+func (c *Cache) equals(a, b any) bool {
+	if c.equal == nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return c.equal(a, b)
+}
+
+// update atomically replaces the entry at key with the result of fn,
+// retrying if another writer changes the entry in the meantime
+func (c *Cache) update(key string, fn func(e *entry) (*entry, error)) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	for {
+		current, exists := c.live(key)
+		if !exists {
+			return keyNotExists(key, c.namespace)
+		}
+		next, err := fn(current.(*entry))
+		if err != nil {
+			return err
+		}
+		if c.storage.CompareAndSwap(key, current, next) {
+			c.publish(key, next.value)
+			return nil
+		}
+	}
+}
+
+// ExpireAfter sets the key's deadline to ttl from now, extending or
+// shortening its lifetime. A ttl of zero or less expires it immediately.
+// It returns an error if the key does not exist.
+func (c *Cache) ExpireAfter(key string, ttl time.Duration) error {
+	if c == nil {
+		return nilCache("")
+	}
+	if err := c.writable(); err != nil {
+		return err
+	}
+	for {
+		current, exists := c.live(key)
+		if !exists {
+			return keyNotExists(key, c.namespace)
+		}
+		e := current.(*entry)
+		now := c.now()
+		if ttl < 0 {
+			ttl = 0
+		}
+		if c.storage.CompareAndSwap(key, current, newEntry(e.value, now.Add(ttl), e.written, e.accessed())) {
+			return nil
+		}
+	}
+}
+
+// Expire removes the key if its deadline has passed and reports whether
+// it was removed. It returns an error if the key does not exist.
+func (c *Cache) Expire(key string) (bool, error) {
+	if c == nil {
+		return false, nilCache("")
+	}
+	value, exists := c.storage.Load(key)
+	if !exists {
+		return false, keyNotExists(key, c.namespace)
+	}
+	if !value.(*entry).expired(c.now()) {
+		return false, nil
+	}
+	return c.storage.CompareAndDelete(key, value), nil
+}
+
+// SetExpiry sets the cache's expiration to an absolute deadline
+func (c *Cache) SetExpiry(t time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire = t
+	c.reindex()
+}
+
+// hasLabel reports whether the cache is labeled key=value
+func (c *Cache) hasLabel(key, value string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.labels[key]
+	return ok && v == value
+}
+
+// ExpiresAt returns the cache's absolute expiration deadline
+func (c *Cache) ExpiresAt() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	return c.expiry()
+}
+
+// renewFor makes ttl the cache's TTL and restarts its expiration from now
+func (c *Cache) renewFor(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+	c.expire = c.now().Add(ttl)
+	c.reindex()
+}
+
+// renew restarts the cache's expiration from now using the TTL it was
+// created with
+func (c *Cache) renew() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire = c.now().Add(c.ttl)
+	c.reindex()
+}
+
+// reindex updates the store's expiry index with the cache's deadline. The
+// caller must hold c.mu.
+func (c *Cache) reindex() {
+	if c.index != nil {
+		c.index.set(c.namespace, c, c.expire)
+	}
+}
+
+// now returns the current time according to the cache's clock
+func (c *Cache) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// expiry returns the cache's expiration deadline
+func (c *Cache) expiry() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.expire
+}
+
+// Purge clears the cache by swapping in empty storage. Every entry present
+// when Purge is called is removed; a concurrent write lands either before
+// the swap and is cleared, or after it and is kept.
 func (c *Cache) Purge() {
+	if c == nil {
+		return
+	}
+	c.storage.clear().Range(func(key, value any) bool {
+		c.audit("remove", key.(string))
+		return true
+	})
+}
+
+// Map returns a map[string]any of the given cache, with values decoded by
+// the cache's value transform. It returns the first decode error.
+func (c *Cache) Map() (map[string]any, error) {
+	if c == nil {
+		return nil, nilCache("")
+	}
+	mp := make(map[string]any, c.sizeHint)
+	var err error
 	c.storage.Range(func(key, value any) bool {
-		if err := c.Remove(key.(string)); err != nil {
-			fmt.Println(err.Error())
+		var decoded any
+		if decoded, err = c.load(value.(*entry).value); err != nil {
 			return false
 		}
+		mp[key.(string)] = decoded
 		return true
 	})
+	if err != nil {
+		return nil, err
+	}
+	return mp, nil
 }
 
-// Map returns a map[string]any of the given cache
-func (c *Cache) Map() (map[string]any, error) {
+// CopyTo streams every entry of the cache, decoded, to sink without
+// building an intermediate map, stopping at and returning the first decode
+// error or error sink returns
+func (c *Cache) CopyTo(sink func(key string, value any) error) error {
+	if c == nil {
+		return nilCache("")
+	}
+	var err error
+	c.storage.Range(func(key, value any) bool {
+		var decoded any
+		if decoded, err = c.load(value.(*entry).value); err != nil {
+			return false
+		}
+		err = sink(key.(string), decoded)
+		return err == nil
+	})
+	return err
+}
+
+// MapWithMeta returns the cache's entries keyed by key, including expired
+// entries flagged as stale. Values are decoded by the cache's value
+// transform; a value that fails to decode is logged and left out.
+func (c *Cache) MapWithMeta() map[string]EntryMeta {
 	if c == nil {
-		return nil, nilCache(c.namespace)
+		return nil
 	}
-	mp := make(map[string]any)
+	now := c.now()
+	mp := make(map[string]EntryMeta, c.sizeHint)
 	c.storage.Range(func(key, value any) bool {
-		mp[key.(string)] = value
+		e := value.(*entry)
+		decoded, ok := c.decodeOrLog(key.(string), e.value)
+		if ok {
+			mp[key.(string)] = EntryMeta{Value: decoded, ExpiresAt: e.expires, Stale: e.expired(now)}
+		}
 		return true
 	})
-	return mp, nil
+	return mp
+}
+
+// Entries returns the unexpired entries of the cache sorted by key. It is
+// equivalent to SortedEntries.
+func (c *Cache) Entries() []Entry {
+	return c.SortedEntries()
+}
+
+// SortedEntries returns the unexpired entries of the cache in ascending key
+// order. Ranging the cache directly visits keys in no particular order;
+// this gives reproducible output for diffing and tests. Values are decoded
+// by the cache's value transform; a value that fails to decode is logged
+// and left out.
+func (c *Cache) SortedEntries() []Entry {
+	entries := c.storedEntries()
+	decoded := entries[:0]
+	for _, e := range entries {
+		if value, ok := c.decodeOrLog(e.Key, e.Value); ok {
+			e.Value = value
+			decoded = append(decoded, e)
+		}
+	}
+	return decoded
+}
+
+// storedEntries is SortedEntries with values left as stored
+func (c *Cache) storedEntries() []Entry {
+	if c == nil {
+		return nil
+	}
+	now := c.now()
+	var entries []Entry
+	c.storage.Range(func(key, value any) bool {
+		e := value.(*entry)
+		if e.expired(now) {
+			return true
+		}
+		entries = append(entries, Entry{Key: key.(string), Value: e.value, ExpiresAt: e.expires})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// decodeOrLog decodes a stored value, logging the error and reporting false
+// if it cannot be decoded
+func (c *Cache) decodeOrLog(key string, stored any) (any, bool) {
+	value, err := c.load(stored)
+	if err != nil {
+		logAt(c.logger, slog.LevelError, "decode failed", "namespace", c.namespace, "key", key, "error", err)
+		return nil, false
+	}
+	return value, true
+}
+
+// Dump writes the cache's unexpired entries to w as a tab-aligned table of
+// key, value and remaining TTL, sorted by key. Keys without a deadline of
+// their own show the cache's remaining TTL.
+func (c *Cache) Dump(w io.Writer) error {
+	if c == nil {
+		return nilCache("")
+	}
+	now := c.now()
+	expire := c.expiry()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tTTL")
+	for _, e := range c.SortedEntries() {
+		deadline := e.ExpiresAt
+		if deadline.IsZero() {
+			deadline = expire
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", e.Key, e.Value, deadline.Sub(now).Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+// Stats returns the cache's hit and miss counts from Get
+func (c *Cache) Stats() Stats {
+	if c == nil || c.stats == nil {
+		return Stats{}
+	}
+	return Stats{
+		Enabled: true,
+		Hits:    c.stats.hits.Load(),
+		Misses:  c.stats.misses.Load(),
+	}
+}
+
+// Merge copies other's unexpired entries, with their deadlines, into c,
+// handling keys present in both according to onConflict. Expired keys in c
+// count as missing. It returns the number of entries applied. Under
+// MergeError the returned error lists every conflicting key.
+func (c *Cache) Merge(other *Cache, onConflict ConflictPolicy) (int, error) {
+	if c == nil {
+		return 0, nilCache("")
+	}
+	if other == nil {
+		return 0, nilCache("")
+	}
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+	switch onConflict {
+	case MergeSkip, MergeOverwrite, MergeError:
+	default:
+		return 0, fmt.Errorf("unknown ConflictPolicy: %d", onConflict)
+	}
+
+	entries := other.storedEntries()
+	for i, e := range entries {
+		value, err := other.load(e.Value)
+		if err == nil {
+			value, err = c.prepare(value)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("merging %s: %w", e.Key, err)
+		}
+		entries[i].Value = value
+	}
+	if onConflict == MergeError {
+		var conflicts []string
+		for _, e := range entries {
+			if _, exists := c.live(e.Key); exists {
+				conflicts = append(conflicts, e.Key)
+			}
+		}
+		if len(conflicts) > 0 {
+			return 0, fmt.Errorf("conflicting keys in %s: %s", c.namespace, strings.Join(conflicts, ", "))
+		}
+	}
+
+	now := c.now()
+	applied := 0
+	var errs []error
+	for _, e := range entries {
+		if _, exists := c.live(e.Key); exists {
+			if onConflict != MergeOverwrite {
+				continue
+			}
+			c.audit("replace", e.Key)
+			c.storage.Store(e.Key, newEntry(e.Value, e.ExpiresAt, now, now))
+			c.publish(e.Key, e.Value)
+			applied++
+			continue
+		}
+		c.audit("add", e.Key)
+		if err := c.add(e.Key, newEntry(e.Value, e.ExpiresAt, now, now)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		applied++
+	}
+	return applied, errors.Join(errs...)
+}
+
+// DiffKeys partitions the keys of c and other into those only in c, those
+// only in other, and those in both. Each slice is sorted.
+func (c *Cache) DiffKeys(other *Cache) (onlyC, onlyOther, both []string) {
+	mine, theirs := c.keySet(), other.keySet()
+
+	for k := range mine {
+		if _, exists := theirs[k]; exists {
+			both = append(both, k)
+		} else {
+			onlyC = append(onlyC, k)
+		}
+	}
+	for k := range theirs {
+		if _, exists := mine[k]; !exists {
+			onlyOther = append(onlyOther, k)
+		}
+	}
+	sort.Strings(onlyC)
+	sort.Strings(onlyOther)
+	sort.Strings(both)
+	return onlyC, onlyOther, both
+}
+
+// keySet returns the set of keys stored in the cache
+func (c *Cache) keySet() map[string]struct{} {
+	keys := make(map[string]struct{})
+	if c == nil {
+		return keys
+	}
+	c.storage.Range(func(key, value any) bool {
+		keys[key.(string)] = struct{}{}
+		return true
+	})
+	return keys
+}
+
+// EqualValues reports whether c and other hold the same keys with values
+// equal under c's comparator. Values are compared decoded, so caches with
+// value transforms compare by what they hold rather than how it is stored;
+// a value that fails to decode makes the caches unequal.
+func (c *Cache) EqualValues(other *Cache) bool {
+	mine, err := c.Map()
+	if err != nil {
+		return false
+	}
+	theirs, err := other.Map()
+	if err != nil {
+		return false
+	}
+	if len(mine) != len(theirs) {
+		return false
+	}
+	for k, v := range mine {
+		w, exists := theirs[k]
+		if !exists || !c.equals(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// Capacity reports the cache's current usage: the number of entries and an
+// estimate of the bytes held by their keys and stored values. The byte
+// figure uses the same rough estimate as WithMaxValueBytes and ignores the
+// sync.Map's own overhead.
+func (c *Cache) Capacity() (entries int, bytes int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.storage.Range(func(key, value any) bool {
+		entries++
+		bytes += int64(len(key.(string))) + approxBytes(value.(*entry).value)
+		return true
+	})
+	return entries, bytes
+}
+
+// SizeByType counts the cache's entries by the dynamic type of their
+// values, keyed by reflect.TypeOf(value).String(), with nil values under
+// "<nil>". Like Size it counts every stored entry. Values are decoded by
+// the cache's value transform first; a value that fails to decode is
+// logged and left out.
+func (c *Cache) SizeByType() map[string]int {
+	if c == nil {
+		return nil
+	}
+	counts := make(map[string]int)
+	c.storage.Range(func(key, value any) bool {
+		v, ok := c.decodeOrLog(key.(string), value.(*entry).value)
+		if !ok {
+			return true
+		}
+		if v == nil {
+			counts["<nil>"]++
+		} else {
+			counts[reflect.TypeOf(v).String()]++
+		}
+		return true
+	})
+	return counts
 }
 
 // Size returns the size of the given cache
@@ -1,10 +1,24 @@
 package cch
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -334,3 +348,4789 @@ func Test_Load(t *testing.T) {
 	}
 	time.Sleep(time.Second * 10)
 }
+
+func Test_Sweep(t *testing.T) {
+	store := NewStore(uuid())
+
+	tests := map[string]struct {
+		ttl   time.Duration
+		empty bool
+	}{
+		"expired and empty":     {ttl: -time.Second, empty: true},
+		"expired and populated": {ttl: -time.Second, empty: false},
+		"live and empty":        {ttl: time.Minute, empty: true},
+	}
+
+	for namespace, tt := range tests {
+		cache, err := store.NewCache(namespace, tt.ttl)
+		if err != nil {
+			t.Error(err)
+		}
+		if !tt.empty {
+			if err := cache.Add("foo", 1); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	removed, err := store.Sweep()
+	if err != nil {
+		t.Error(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 namespace removed but got %d", removed)
+	}
+	if store.Size() != 2 {
+		t.Errorf("expected store size of 2 but got %d", store.Size())
+	}
+	if _, err := store.UseNamespace("expired and empty"); err == nil {
+		t.Error("expected the expired and empty namespace to be removed")
+	}
+}
+
+type base64Codec struct {
+	JSONCodec
+}
+
+func (c base64Codec) Marshal(v any) ([]byte, error) {
+	data, err := c.JSONCodec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(data)), nil
+}
+
+func (c base64Codec) Unmarshal(data []byte, v any) error {
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+	return c.JSONCodec.Unmarshal(decoded, v)
+}
+
+func Test_Codec(t *testing.T) {
+	store := NewStore("codec store")
+
+	tests := map[string]map[string]any{
+		"namespace test 1": {"foo": "1", "bar": "2"},
+		"namespace test 2": {"baz": "3"},
+	}
+
+	for namespace, entries := range tests {
+		cache, err := store.NewCache(namespace, time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		for k, v := range entries {
+			if err := cache.Add(k, v); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, base64Codec{}} {
+		var buf bytes.Buffer
+		if err := store.Save(&buf, codec); err != nil {
+			t.Fatal(err)
+		}
+
+		restored, err := Restore(&buf, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if restored.id != store.id {
+			t.Errorf("expected id %s but got %s", store.id, restored.id)
+		}
+
+		for namespace, entries := range tests {
+			cache, err := restored.UseNamespace(namespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cache.Map()
+			if err != nil {
+				t.Error(err)
+			}
+			if !reflect.DeepEqual(got, entries) {
+				t.Errorf("expected %v but got %v", entries, got)
+			}
+		}
+	}
+}
+
+func Test_Swap(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("swap", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+
+	old, err := cache.Swap("foo", 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if old != 1 {
+		t.Errorf("expected %v but got %v", 1, old)
+	}
+
+	v, exists := cache.Get("foo")
+	if !exists {
+		t.Error("key does not exist")
+	}
+	if v != 2 {
+		t.Errorf("expected %v but got %v", 2, v)
+	}
+
+	if _, err := cache.Swap("bar", 3); err == nil {
+		t.Error("expected an error swapping a missing key")
+	}
+	if _, exists := cache.Get("bar"); exists {
+		t.Error("expected missing key to stay absent after a failed swap")
+	}
+}
+
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordHandler) WithGroup(string) slog.Handler { return h }
+
+func Test_Logger(t *testing.T) {
+	handler := new(recordHandler)
+	store := NewStore(uuid(), WithLogger(slog.New(handler)))
+
+	if _, err := store.NewCache("expiring", -time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := store.ExpireCache(); err != nil {
+		t.Error(err)
+	}
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	found := false
+	for _, r := range handler.records {
+		if r.Message != "cache expired" {
+			continue
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "namespace" && a.Value.String() == "expiring" {
+				found = true
+				return false
+			}
+			return true
+		})
+	}
+	if !found {
+		t.Error("expected an expiry record with the namespace attribute")
+	}
+}
+
+func Test_TTLRemaining(t *testing.T) {
+	store := NewStore(uuid())
+
+	tests := map[string]time.Duration{
+		"short":   time.Second,
+		"medium":  time.Minute,
+		"long":    time.Hour,
+		"expired": -time.Second,
+	}
+
+	for namespace, ttl := range tests {
+		if _, err := store.NewCache(namespace, ttl); err != nil {
+			t.Error(err)
+		}
+	}
+
+	remaining := store.TTLRemaining()
+	if len(remaining) != len(tests) {
+		t.Errorf("expected %d namespaces but got %d", len(tests), len(remaining))
+	}
+
+	for namespace, ttl := range tests {
+		got := remaining[namespace]
+		if ttl < 0 {
+			if got != 0 {
+				t.Errorf("expected %s to be clamped to 0 but got %v", namespace, got)
+			}
+			continue
+		}
+		if got > ttl || got < ttl-time.Second {
+			t.Errorf("expected %s to have about %v remaining but got %v", namespace, ttl, got)
+		}
+	}
+
+	if !(remaining["short"] < remaining["medium"] && remaining["medium"] < remaining["long"]) {
+		t.Errorf("expected remaining durations in ttl order but got %v", remaining)
+	}
+}
+
+func Test_SetExpiry(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("set expiry", time.Hour)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := store.ExpireCache(); err != nil {
+		t.Error(err)
+	}
+	if store.Size() != 1 {
+		t.Errorf("expected store size of 1 but got %d", store.Size())
+	}
+
+	cache.SetExpiry(time.Now().Add(-time.Second))
+
+	if err := store.ExpireCache(); err != nil {
+		t.Error(err)
+	}
+	if store.Size() != 0 {
+		t.Errorf("expected store to be empty but got a size of %d", store.Size())
+	}
+}
+
+func Test_Snapshot(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("snapshot", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+
+	snap := store.Snapshot()
+
+	if err := cache.Replace("foo", 2); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("bar", 3); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.NewCache("after snapshot", time.Minute); err != nil {
+		t.Error(err)
+	}
+
+	if snap.Size() != 1 {
+		t.Errorf("expected snapshot size of 1 but got %d", snap.Size())
+	}
+	if !reflect.DeepEqual(snap.Namespaces(), []string{"snapshot"}) {
+		t.Errorf("expected [snapshot] but got %v", snap.Namespaces())
+	}
+
+	got, exists := snap.Get("snapshot", "foo")
+	if !exists {
+		t.Error("key does not exist")
+	}
+	if got != 1 {
+		t.Errorf("expected %v but got %v", 1, got)
+	}
+	if _, exists := snap.Get("snapshot", "bar"); exists {
+		t.Error("expected key added after the snapshot to be absent")
+	}
+}
+
+func Test_WriteRate(t *testing.T) {
+	store := NewStore(uuid(), WithWriteRate(10))
+	cache, err := store.NewCache("rate limited", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rejected := 0
+	for i := 0; i < 20; i++ {
+		err := cache.Add(fmt.Sprintf("burst %d", i), i)
+		if errors.Is(err, ErrRateLimited) {
+			rejected++
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	if rejected == 0 {
+		t.Error("expected some burst writes to be rate limited")
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond * 150)
+		if err := cache.Add(fmt.Sprintf("steady %d", i), i); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func Test_TypedCache(t *testing.T) {
+	store := NewStore(uuid())
+
+	ints, err := store.NewIntCache("ints", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ints.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+	if err := ints.Replace("foo", 2); err != nil {
+		t.Error(err)
+	}
+	i, err := ints.Get("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if i != 2 {
+		t.Errorf("expected %d but got %d", 2, i)
+	}
+
+	strs, err := store.NewStringCache("strings", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := strs.Add("foo", "bar"); err != nil {
+		t.Error(err)
+	}
+	if err := strs.Replace("foo", "baz"); err != nil {
+		t.Error(err)
+	}
+	str, err := strs.Get("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if str != "baz" {
+		t.Errorf("expected %s but got %s", "baz", str)
+	}
+
+	bs, err := store.NewBytesCache("bytes", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Add("foo", []byte("bar")); err != nil {
+		t.Error(err)
+	}
+	if err := bs.Replace("foo", []byte("baz")); err != nil {
+		t.Error(err)
+	}
+	b, err := bs.Get("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(b, []byte("baz")) {
+		t.Errorf("expected %s but got %s", "baz", b)
+	}
+
+	if _, err := ints.Get("missing"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+
+	if err := ints.Cache().Add("mismatch", "not an int"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ints.Get("mismatch"); err == nil {
+		t.Error("expected a type mismatch error")
+	}
+}
+
+func Test_ExpireKey(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("expire key", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := cache.AddWithTTL("expired", 1, -time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := cache.AddWithTTL("live", 2, time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("forever", 3); err != nil {
+		t.Error(err)
+	}
+
+	for key, want := range map[string]bool{"expired": true, "live": false, "forever": false} {
+		removed, err := cache.Expire(key)
+		if err != nil {
+			t.Error(err)
+		}
+		if removed != want {
+			t.Errorf("expected %s removed to be %v but got %v", key, want, removed)
+		}
+	}
+
+	if _, exists := cache.Get("expired"); exists {
+		t.Error("expected expired key to be removed")
+	}
+	if _, exists := cache.Get("live"); !exists {
+		t.Error("expected live key to remain")
+	}
+
+	if _, err := cache.Expire("missing"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func Test_NewStoreFromMap(t *testing.T) {
+	data := map[string]map[string]any{
+		"namespace test 1": {"foo": 1, "bar": 2},
+		"namespace test 2": {"baz": 3},
+	}
+
+	store, err := NewStoreFromMap(uuid(), data, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Size() != len(data) {
+		t.Errorf("expected a store size of %d but got %d", len(data), store.Size())
+	}
+
+	for namespace, entries := range data {
+		cache, err := store.UseNamespace(namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range entries {
+			got, exists := cache.Get(k)
+			if !exists {
+				t.Error("key does not exist")
+			}
+			if got != v {
+				t.Errorf("expected %v but got %v", v, got)
+			}
+		}
+	}
+
+	if _, err := NewStoreFromMap(uuid(), data, -time.Second); err == nil {
+		t.Error("expected an error for a negative ttl")
+	}
+}
+
+func Test_Entries(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("entries", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	before := time.Now()
+	if err := cache.AddWithTTL("foo", 1, time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := cache.AddWithTTL("bar", 2, time.Hour); err != nil {
+		t.Error(err)
+	}
+	if err := cache.AddWithTTL("expired", 3, -time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("baz", 4); err != nil {
+		t.Error(err)
+	}
+	after := time.Now()
+
+	entries := cache.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries but got %d", len(entries))
+	}
+
+	keys := []string{entries[0].Key, entries[1].Key, entries[2].Key}
+	if !reflect.DeepEqual(keys, []string{"bar", "baz", "foo"}) {
+		t.Errorf("expected sorted keys but got %v", keys)
+	}
+
+	ttls := map[string]time.Duration{"foo": time.Minute, "bar": time.Hour}
+	for _, e := range entries {
+		ttl, ok := ttls[e.Key]
+		if !ok {
+			if !e.ExpiresAt.IsZero() {
+				t.Errorf("expected %s to have no deadline but got %v", e.Key, e.ExpiresAt)
+			}
+			continue
+		}
+		if e.ExpiresAt.Before(before.Add(ttl)) || e.ExpiresAt.After(after.Add(ttl)) {
+			t.Errorf("expected %s to expire %v from insert but got %v", e.Key, ttl, e.ExpiresAt)
+		}
+	}
+}
+
+func Test_RemoveEmpty(t *testing.T) {
+	store := NewStore(uuid())
+
+	namespaces := []string{
+		"namespace test 1",
+		"namespace test 2",
+		"namespace test 3",
+	}
+
+	for _, namespace := range namespaces {
+		cache, err := store.NewCache(namespace, time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := cache.Add("foo", 1); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, namespace := range namespaces[:2] {
+		cache, err := store.UseNamespace(namespace)
+		if err != nil {
+			t.Error(err)
+		}
+		cache.Purge()
+	}
+
+	if removed := store.RemoveEmpty(); removed != 2 {
+		t.Errorf("expected 2 namespaces removed but got %d", removed)
+	}
+	if !reflect.DeepEqual(store.Namespaces(), namespaces[2:]) {
+		t.Errorf("expected %v but got %v", namespaces[2:], store.Namespaces())
+	}
+}
+
+func Test_AddWith(t *testing.T) {
+	store := NewStore(uuid())
+
+	tests := map[OnExists]struct {
+		want    any
+		wantErr bool
+	}{
+		Reject:    {want: 1, wantErr: true},
+		Overwrite: {want: 2, wantErr: false},
+		Keep:      {want: 1, wantErr: false},
+	}
+
+	for onExists, tt := range tests {
+		cache, err := store.NewCache(fmt.Sprintf("add with %d", onExists), time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := cache.Add("foo", 1); err != nil {
+			t.Error(err)
+		}
+
+		err = cache.AddWith("foo", 2, onExists)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expected error %v but got %v", tt.wantErr, err)
+		}
+
+		got, exists := cache.Get("foo")
+		if !exists {
+			t.Error("key does not exist")
+		}
+		if got != tt.want {
+			t.Errorf("expected %v but got %v", tt.want, got)
+		}
+
+		if err := cache.AddWith("bar", 3, onExists); err != nil {
+			t.Error(err)
+		}
+		if got, _ := cache.Get("bar"); got != 3 {
+			t.Errorf("expected %v but got %v", 3, got)
+		}
+	}
+}
+
+func Test_Subscribe(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("subscribe", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ch, unsubscribe := cache.Subscribe("foo")
+
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("bar", 100); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Replace("foo", 2); err != nil {
+		t.Error(err)
+	}
+
+	for _, want := range []int{1, 2} {
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Errorf("expected %v but got %v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	unsubscribe()
+	if err := cache.Replace("foo", 3); err != nil {
+		t.Error(err)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("expected channel to be closed after unsubscribe")
+	}
+}
+
+func Test_IncrementFloat(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	store := NewStore(uuid())
+	cache, err := store.NewCache("increment float", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := cache.Add("sum", 1.3); err != nil {
+		t.Error(err)
+	}
+
+	workers, increments := 10, 100
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if _, err := cache.IncrementFloat("sum", 0.01); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, _ := cache.Get("sum")
+	want := 1.3 + float64(workers*increments)*0.01
+	if math.Abs(got.(float64)-want) > 1e-9 {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	if _, err := cache.IncrementFloat("missing", 1); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+
+	if err := cache.Add("int", 1); err != nil {
+		t.Error(err)
+	}
+	if _, err := cache.IncrementFloat("int", 1); err == nil {
+		t.Error("expected an error for a non-float64 value")
+	}
+}
+
+func Test_Has(t *testing.T) {
+	store := NewStore(uuid())
+	if _, err := store.NewCache("exists", time.Minute); err != nil {
+		t.Error(err)
+	}
+
+	if !store.Has("exists") {
+		t.Error("expected namespace to exist")
+	}
+	if store.Has("missing") {
+		t.Error("expected namespace to be missing")
+	}
+
+	var nilStore *Store
+	if nilStore.Has("exists") {
+		t.Error("expected a nil store to have no namespaces")
+	}
+}
+
+func Test_MapWithMeta(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("map with meta", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ttls := map[string]time.Duration{
+		"foo": time.Minute,
+		"bar": time.Hour,
+		"baz": -time.Second,
+	}
+
+	before := time.Now()
+	for k, ttl := range ttls {
+		if err := cache.AddWithTTL(k, k, ttl); err != nil {
+			t.Error(err)
+		}
+	}
+	after := time.Now()
+
+	meta := cache.MapWithMeta()
+	if len(meta) != len(ttls) {
+		t.Errorf("expected %d entries but got %d", len(ttls), len(meta))
+	}
+
+	for k, ttl := range ttls {
+		m, ok := meta[k]
+		if !ok {
+			t.Errorf("expected %s in metadata", k)
+			continue
+		}
+		if m.Value != k {
+			t.Errorf("expected %v but got %v", k, m.Value)
+		}
+		if m.ExpiresAt.Before(before.Add(ttl)) || m.ExpiresAt.After(after.Add(ttl)) {
+			t.Errorf("expected %s to expire %v from insert but got %v", k, ttl, m.ExpiresAt)
+		}
+		if m.Stale != (ttl < 0) {
+			t.Errorf("expected %s stale to be %v but got %v", k, ttl < 0, m.Stale)
+		}
+	}
+}
+
+func Test_TieredStore(t *testing.T) {
+	store := NewStore(uuid())
+	hot, err := store.NewCache("hot", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	cold, err := store.NewCache("cold", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	tiered := NewTieredStore(hot, cold, 2)
+
+	for i, k := range []string{"foo", "bar", "baz"} {
+		if err := tiered.Set(k, i); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if hot.Size() != 0 {
+		t.Errorf("expected writes to skip the hot tier but got a size of %d", hot.Size())
+	}
+
+	got, exists := tiered.Get("foo")
+	if !exists {
+		t.Error("key does not exist")
+	}
+	if got != 0 {
+		t.Errorf("expected %v but got %v", 0, got)
+	}
+	if _, exists := hot.Get("foo"); !exists {
+		t.Error("expected a cold hit to promote the key into the hot tier")
+	}
+
+	tiered.Get("bar")
+	tiered.Get("baz")
+	if hot.Size() != 2 {
+		t.Errorf("expected hot tier to be bounded at 2 but got %d", hot.Size())
+	}
+	if cold.Size() != 3 {
+		t.Errorf("expected cold tier to keep all 3 entries but got %d", cold.Size())
+	}
+
+	if err := tiered.Set("baz", 10); err != nil {
+		t.Error(err)
+	}
+	if got, _ := tiered.Get("baz"); got != 10 {
+		t.Errorf("expected %v but got %v", 10, got)
+	}
+}
+
+func Test_RenameKey(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("rename key", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := cache.AddWithTTL("foo", 1, time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("bar", 2); err != nil {
+		t.Error(err)
+	}
+	before := cache.MapWithMeta()["foo"].ExpiresAt
+
+	if err := cache.RenameKey("foo", "baz"); err != nil {
+		t.Error(err)
+	}
+
+	if _, exists := cache.Get("foo"); exists {
+		t.Error("expected old key to be gone")
+	}
+	got, exists := cache.Get("baz")
+	if !exists {
+		t.Error("key does not exist")
+	}
+	if got != 1 {
+		t.Errorf("expected %v but got %v", 1, got)
+	}
+	if after := cache.MapWithMeta()["baz"].ExpiresAt; !after.Equal(before) {
+		t.Errorf("expected deadline %v to be preserved but got %v", before, after)
+	}
+
+	if err := cache.RenameKey("missing", "qux"); err == nil {
+		t.Error("expected an error renaming a missing key")
+	}
+	if err := cache.RenameKey("baz", "bar"); err == nil {
+		t.Error("expected an error renaming onto an existing key")
+	}
+	if got, _ := cache.Get("bar"); got != 2 {
+		t.Errorf("expected %v but got %v", 2, got)
+	}
+}
+
+func Test_MaxValueBytes(t *testing.T) {
+	store := NewStore(uuid(), WithMaxValueBytes(1<<10))
+	cache, err := store.NewCache("max value bytes", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := cache.Add("small", "small value"); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("large", rando(1<<12)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected %v but got %v", ErrValueTooLarge, err)
+	}
+	if _, exists := cache.Get("large"); exists {
+		t.Error("expected oversized value to be rejected")
+	}
+	if err := cache.Replace("small", []byte(rando(1<<12))); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected %v but got %v", ErrValueTooLarge, err)
+	}
+}
+
+func Test_DrainNamespace(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("drain", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+
+	if err := store.DrainNamespace("drain"); err != nil {
+		t.Error(err)
+	}
+
+	if err := cache.Add("bar", 2); !errors.Is(err, ErrDraining) {
+		t.Errorf("expected %v but got %v", ErrDraining, err)
+	}
+	if err := cache.Replace("foo", 2); !errors.Is(err, ErrDraining) {
+		t.Errorf("expected %v but got %v", ErrDraining, err)
+	}
+
+	got, exists := cache.Get("foo")
+	if !exists {
+		t.Error("key does not exist")
+	}
+	if got != 1 {
+		t.Errorf("expected %v but got %v", 1, got)
+	}
+
+	if err := store.Remove("drain"); err != nil {
+		t.Error(err)
+	}
+	if store.Has("drain") {
+		t.Error("expected drained namespace to be removed")
+	}
+
+	if err := store.DrainNamespace("missing"); err == nil {
+		t.Error("expected an error draining a missing namespace")
+	}
+}
+
+func Test_Ring(t *testing.T) {
+	stores := []*Store{NewStore("ring 1"), NewStore("ring 2"), NewStore("ring 3"), NewStore("ring 4")}
+	ring := NewRing(stores...)
+
+	namespaces := make([]string, 1000)
+	owners := make(map[string]*Store, len(namespaces))
+	counts := make(map[*Store]int)
+	for i := range namespaces {
+		namespaces[i] = fmt.Sprintf("namespace %d", i)
+		owner := ring.StoreFor(namespaces[i])
+		owners[namespaces[i]] = owner
+		counts[owner]++
+	}
+
+	for _, s := range stores {
+		if counts[s] == 0 {
+			t.Errorf("expected store %s to own some namespaces", s.id)
+		}
+	}
+
+	ring.AddStore(NewStore("ring 5"))
+
+	moved := 0
+	for _, namespace := range namespaces {
+		if ring.StoreFor(namespace) != owners[namespace] {
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(namespaces)/2 {
+		t.Errorf("expected a fraction of namespaces to move but %d of %d moved", moved, len(namespaces))
+	}
+
+	cache, err := ring.NewCache("routed", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	got, err := ring.UseNamespace("routed")
+	if err != nil {
+		t.Error(err)
+	}
+	if got != cache {
+		t.Error("expected UseNamespace to return the routed cache")
+	}
+	if !ring.StoreFor("routed").Has("routed") {
+		t.Error("expected the owning store to hold the namespace")
+	}
+
+	ring.RemoveStore("ring 5")
+	for _, namespace := range namespaces {
+		if ring.StoreFor(namespace) != owners[namespace] {
+			t.Errorf("expected %s to return to its original store", namespace)
+		}
+	}
+}
+
+func Test_Wait(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("wait", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	result := make(chan any)
+	go func() {
+		value, err := cache.Wait(context.Background(), "foo")
+		if err != nil {
+			t.Error(err)
+		}
+		result <- value
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case got := <-result:
+		if got != 1 {
+			t.Errorf("expected %v but got %v", 1, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the waiter")
+	}
+
+	got, err := cache.Wait(context.Background(), "foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if got != 1 {
+		t.Errorf("expected %v but got %v", 1, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := cache.Wait(ctx, "missing"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func Test_TTLHistogram(t *testing.T) {
+	store := NewStore(uuid())
+
+	ttls := []time.Duration{
+		time.Second * 5,
+		time.Second * 30,
+		time.Minute * 5,
+		time.Minute * 30,
+		time.Minute * 45,
+		time.Hour * 2,
+	}
+	for i, ttl := range ttls {
+		if _, err := store.NewCache(fmt.Sprintf("namespace %d", i), ttl); err != nil {
+			t.Error(err)
+		}
+	}
+
+	histogram := store.TTLHistogram([]time.Duration{time.Hour, time.Minute, time.Minute * 10})
+	want := map[time.Duration]int{
+		time.Minute:      2,
+		time.Minute * 10: 1,
+		time.Hour:        2,
+	}
+	if !reflect.DeepEqual(histogram, want) {
+		t.Errorf("expected %v but got %v", want, histogram)
+	}
+}
+
+func Test_SweepErrors(t *testing.T) {
+	store := NewStore(uuid())
+
+	namespaces := []string{
+		"namespace test 1",
+		"namespace test 2",
+		"namespace test 3",
+	}
+	for _, namespace := range namespaces {
+		if _, err := store.NewCache(namespace, -time.Second); err != nil {
+			t.Error(err)
+		}
+	}
+
+	store.Lock()
+	store.data["broken"] = nil
+	store.Unlock()
+	store.expiries.set("broken", nil, time.Time{})
+
+	removed, err := store.Sweep()
+	if err == nil {
+		t.Fatal("expected an error for the broken namespace")
+	}
+	if !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the error to mention the broken namespace but got %v", err)
+	}
+	if removed != len(namespaces) {
+		t.Errorf("expected %d namespaces removed but got %d", len(namespaces), removed)
+	}
+	if !reflect.DeepEqual(store.Namespaces(), []string{"broken"}) {
+		t.Errorf("expected only the broken namespace to remain but got %v", store.Namespaces())
+	}
+}
+
+func Test_Rebalance(t *testing.T) {
+	data := map[string]map[string]any{
+		"namespace test 1": {"foo": 1, "bar": 2},
+		"namespace test 2": {"baz": 3},
+		"target":           {"qux": 4},
+	}
+	store, err := NewStoreFromMap(uuid(), data, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Rebalance(func(namespace, key string, value any) string {
+		return "target"
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	target, err := store.UseNamespace("target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := target.Map()
+	if err != nil {
+		t.Error(err)
+	}
+	want := map[string]any{"foo": 1, "bar": 2, "baz": 3, "qux": 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	for _, namespace := range []string{"namespace test 1", "namespace test 2"} {
+		cache, err := store.UseNamespace(namespace)
+		if err != nil {
+			t.Error(err)
+		}
+		if cache.Size() != 0 {
+			t.Errorf("expected %s to be empty but got a size of %d", namespace, cache.Size())
+		}
+	}
+
+	err = store.Rebalance(func(namespace, key string, value any) string {
+		return "created"
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if !store.Has("created") {
+		t.Error("expected the target namespace to be created")
+	}
+}
+
+type binaryPoint struct {
+	X, Y int
+}
+
+func Test_MarshalBinary(t *testing.T) {
+	gob.Register(binaryPoint{})
+
+	store := NewStore(uuid())
+	cache, err := store.NewCache("binary", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	tests := map[string]any{
+		"foo": 1,
+		"bar": "two",
+		"baz": binaryPoint{X: 3, Y: 4},
+	}
+	for k, v := range tests {
+		if err := cache.Add(k, v); err != nil {
+			t.Error(err)
+		}
+	}
+
+	data, err := cache.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := new(Cache)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.namespace != cache.namespace {
+		t.Errorf("expected namespace %s but got %s", cache.namespace, restored.namespace)
+	}
+	if !restored.expiry().Equal(cache.expiry()) {
+		t.Errorf("expected expiry %v but got %v", cache.expiry(), restored.expiry())
+	}
+
+	want, _ := cache.Map()
+	got, err := restored.Map()
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+}
+
+func Test_ManualClock(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := NewStore(uuid(), WithClock(clock))
+
+	cache, err := store.NewCache("manual clock", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := cache.AddWithTTL("foo", 1, time.Second); err != nil {
+		t.Error(err)
+	}
+
+	if removed, _ := store.Sweep(); removed != 0 {
+		t.Errorf("expected no namespaces removed but got %d", removed)
+	}
+
+	clock.Advance(time.Second * 2)
+	if removed, err := cache.Expire("foo"); err != nil || !removed {
+		t.Errorf("expected key to expire after advancing the clock, got %v %v", removed, err)
+	}
+
+	if removed, _ := store.Sweep(); removed != 0 {
+		t.Errorf("expected no namespaces removed but got %d", removed)
+	}
+
+	clock.Advance(time.Minute)
+	if removed, _ := store.Sweep(); removed != 1 {
+		t.Errorf("expected 1 namespace removed but got %d", removed)
+	}
+	if store.Size() != 0 {
+		t.Errorf("expected store to be empty but got a size of %d", store.Size())
+	}
+}
+
+func Test_AuditHook(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("audit", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var ops []string
+	cache.SetAuditHook(func(op, key string) {
+		ops = append(ops, op+" "+key)
+	})
+
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+	cache.Get("foo")
+	if err := cache.Replace("foo", 2); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Remove("foo"); err != nil {
+		t.Error(err)
+	}
+	cache.Get("bar")
+
+	want := []string{"add foo", "get foo", "replace foo", "remove foo", "get bar"}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("expected %v but got %v", want, ops)
+	}
+
+	cache.SetAuditHook(nil)
+	cache.Get("foo")
+	if len(ops) != len(want) {
+		t.Errorf("expected no calls after removing the hook but got %v", ops[len(want):])
+	}
+}
+
+func Test_Clone(t *testing.T) {
+	data := map[string]map[string]any{
+		"namespace test 1": {"foo": 1, "bar": 2},
+		"namespace test 2": {"baz": []int{1, 2, 3}},
+	}
+	store, err := NewStoreFromMap(uuid(), data, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := store.Clone("clone")
+	if clone.id != "clone" {
+		t.Errorf("expected id %s but got %s", "clone", clone.id)
+	}
+	if !reflect.DeepEqual(clone.Namespaces(), store.Namespaces()) {
+		t.Errorf("expected %v but got %v", store.Namespaces(), clone.Namespaces())
+	}
+	for namespace := range data {
+		original, _ := store.UseNamespace(namespace)
+		cloned, _ := clone.UseNamespace(namespace)
+		if !cloned.expiry().Equal(original.expiry()) {
+			t.Errorf("expected expiry %v but got %v", original.expiry(), cloned.expiry())
+		}
+	}
+
+	cache, err := clone.UseNamespace("namespace test 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Replace("foo", 10); err != nil {
+		t.Error(err)
+	}
+	if err := clone.Remove("namespace test 2"); err != nil {
+		t.Error(err)
+	}
+	if _, err := clone.NewCache("namespace test 3", time.Minute); err != nil {
+		t.Error(err)
+	}
+
+	if store.Size() != 2 || !store.Has("namespace test 2") || store.Has("namespace test 3") {
+		t.Errorf("expected original namespaces to be unchanged but got %v", store.Namespaces())
+	}
+	original, _ := store.UseNamespace("namespace test 1")
+	if got, _ := original.Get("foo"); got != 1 {
+		t.Errorf("expected %v but got %v", 1, got)
+	}
+
+	deep := store.CloneFunc("deep clone", func(value any) any {
+		if s, ok := value.([]int); ok {
+			return append([]int(nil), s...)
+		}
+		return value
+	})
+	deepCache, _ := deep.UseNamespace("namespace test 2")
+	got, _ := deepCache.Get("baz")
+	got.([]int)[0] = 100
+	originalCache, _ := store.UseNamespace("namespace test 2")
+	if v, _ := originalCache.Get("baz"); v.([]int)[0] != 1 {
+		t.Errorf("expected a deep copy to leave the original untouched but got %v", v)
+	}
+}
+
+func Test_RemoveMany(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("remove many", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, k := range []string{"foo", "bar", "baz"} {
+		if err := cache.Add(k, k); err != nil {
+			t.Error(err)
+		}
+	}
+
+	removed := cache.RemoveMany([]string{"foo", "missing", "baz", "foo"})
+	if removed != 2 {
+		t.Errorf("expected 2 keys removed but got %d", removed)
+	}
+	if cache.Size() != 1 {
+		t.Errorf("expected a cache size of 1 but got %d", cache.Size())
+	}
+	if _, exists := cache.Get("bar"); !exists {
+		t.Error("expected bar to remain")
+	}
+}
+
+func Test_RestoreSnapshot(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := NewStore(uuid(), WithClock(clock))
+
+	cache, err := store.NewCache("restore", time.Hour)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := store.NewCache("short lived", time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := cache.AddWithTTL("short", 1, time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := cache.AddWithTTL("long", 2, time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("forever", 3); err != nil {
+		t.Error(err)
+	}
+	wantExpiry := cache.MapWithMeta()["long"].ExpiresAt
+
+	snap := store.Snapshot()
+	clock.Advance(time.Second * 2)
+
+	restored := NewStore(uuid(), WithClock(clock))
+	if err := restored.RestoreSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Has("short lived") {
+		t.Error("expected expired namespace to be skipped")
+	}
+	got, err := restored.UseNamespace("restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.expiry().Equal(cache.expiry()) {
+		t.Errorf("expected expiry %v but got %v", cache.expiry(), got.expiry())
+	}
+
+	meta := got.MapWithMeta()
+	if _, exists := meta["short"]; exists {
+		t.Error("expected expired entry to be dropped")
+	}
+	if m, exists := meta["long"]; !exists || !m.ExpiresAt.Equal(wantExpiry) {
+		t.Errorf("expected long to keep its expiry %v but got %v", wantExpiry, m.ExpiresAt)
+	}
+	if _, exists := meta["forever"]; !exists {
+		t.Error("expected entry without a deadline to be restored")
+	}
+}
+
+func Test_LastAccess(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := NewStore(uuid(), WithClock(clock))
+	cache, err := store.NewCache("last access", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	written := clock.Now()
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+	got, err := cache.LastAccess("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if !got.Equal(written) {
+		t.Errorf("expected %v but got %v", written, got)
+	}
+
+	clock.Advance(time.Second * 5)
+	read := clock.Now()
+	cache.Get("foo")
+
+	got, err = cache.LastAccess("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if !got.Equal(read) {
+		t.Errorf("expected %v but got %v", read, got)
+	}
+
+	wallStore := NewStore(uuid())
+	wallCache, _ := wallStore.NewCache("wall clock", time.Minute)
+	if err := wallCache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	wallCache.Get("foo")
+	got, _ = wallCache.LastAccess("foo")
+	if time.Since(got) > time.Millisecond*20 {
+		t.Errorf("expected last access to reflect the read but it was %v ago", time.Since(got))
+	}
+
+	if _, err := cache.LastAccess("missing"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func Test_WalkExpired(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := NewStore(uuid(), WithClock(clock))
+
+	for namespace, ttl := range map[string]time.Duration{
+		"expired 1": time.Second,
+		"expired 2": time.Second * 2,
+		"live":      time.Minute,
+	} {
+		if _, err := store.NewCache(namespace, ttl); err != nil {
+			t.Error(err)
+		}
+	}
+	populated, err := store.NewCache("populated", time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := populated.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+
+	clock.Advance(time.Second * 5)
+
+	var walked []string
+	store.WalkExpired(func(namespace string, c *Cache) {
+		if c.namespace != namespace {
+			t.Errorf("expected cache for %s but got %s", namespace, c.namespace)
+		}
+		walked = append(walked, namespace)
+	})
+	sort.Strings(walked)
+
+	want := []string{"expired 1", "expired 2"}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("expected %v but got %v", want, walked)
+	}
+	if store.Size() != 4 {
+		t.Errorf("expected walking to remove nothing but got a store size of %d", store.Size())
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("stats disabled", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+	cache.Get("foo")
+	cache.Get("bar")
+	if stats := cache.Stats(); stats != (Stats{}) {
+		t.Errorf("expected disabled stats to be zero but got %+v", stats)
+	}
+
+	store = NewStore(uuid(), WithStats())
+	cache, err = store.NewCache("stats enabled", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+	cache.Get("foo")
+	cache.Get("foo")
+	cache.Get("bar")
+	want := Stats{Enabled: true, Hits: 2, Misses: 1}
+	if stats := cache.Stats(); stats != want {
+		t.Errorf("expected %+v but got %+v", want, stats)
+	}
+}
+
+func benchmarkGet(b *testing.B, opts ...Option) {
+	store := NewStore(uuid(), opts...)
+	cache, _ := store.NewCache("benchmark", time.Minute)
+	for i := 0; i < 1000; i++ {
+		_ = cache.Add(fmt.Sprintf("key %d", i), i)
+	}
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key %d", i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Get(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	b.Run("stats disabled", func(b *testing.B) { benchmarkGet(b) })
+	b.Run("stats enabled", func(b *testing.B) { benchmarkGet(b, WithStats()) })
+}
+
+func Test_SetIfGreater(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	store := NewStore(uuid())
+	cache, err := store.NewCache("set if greater", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var max int64
+	values := make(chan int64, 1000)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			for j := int64(0); j < 100; j++ {
+				v := (seed*7919 + j*104729) % 100000
+				values <- v
+				if _, err := cache.SetIfGreater("high water", v); err != nil {
+					t.Error(err)
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(values)
+	for v := range values {
+		if v > max {
+			max = v
+		}
+	}
+
+	got, _ := cache.Get("high water")
+	if got != max {
+		t.Errorf("expected %v but got %v", max, got)
+	}
+
+	updated, err := cache.SetIfGreater("high water", max)
+	if err != nil {
+		t.Error(err)
+	}
+	if updated {
+		t.Error("expected an equal value not to update")
+	}
+
+	if err := cache.Add("int", 1); err != nil {
+		t.Error(err)
+	}
+	if _, err := cache.SetIfGreater("int", 2); err == nil {
+		t.Error("expected an error for a non-int64 value")
+	}
+}
+
+func Test_StreamJSON(t *testing.T) {
+	store := NewStore(uuid())
+
+	namespaces, entries := 10, 1000
+	for i := 0; i < namespaces; i++ {
+		cache, err := store.NewCache(fmt.Sprintf("namespace %d", i), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < entries; j++ {
+			if err := cache.AddWithTTL(fmt.Sprintf("key %d", j), fmt.Sprintf("value %d", j), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(store.StreamJSON(w))
+	}()
+
+	loaded, err := StreamLoad(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.id != store.id {
+		t.Errorf("expected id %s but got %s", store.id, loaded.id)
+	}
+	if loaded.Size() != namespaces {
+		t.Errorf("expected %d namespaces but got %d", namespaces, loaded.Size())
+	}
+	for _, namespace := range store.Namespaces() {
+		original, _ := store.UseNamespace(namespace)
+		cache, err := loaded.UseNamespace(namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cache.Size() != entries {
+			t.Errorf("expected %d entries in %s but got %d", entries, namespace, cache.Size())
+		}
+		if !cache.expiry().Equal(original.expiry()) {
+			t.Errorf("expected expiry %v but got %v", original.expiry(), cache.expiry())
+		}
+		if got, _ := cache.Get("key 42"); got != "value 42" {
+			t.Errorf("expected %v but got %v", "value 42", got)
+		}
+	}
+}
+
+func Test_ReplaceFunc(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	store := NewStore(uuid())
+	cache, err := store.NewCache("replace func", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("foo", 0); err != nil {
+		t.Error(err)
+	}
+
+	workers, increments := 10, 100
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				err := cache.ReplaceFunc("foo", func(old any) (any, error) {
+					return old.(int) + 1, nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, _ := cache.Get("foo")
+	if got != workers*increments {
+		t.Errorf("expected %d but got %v", workers*increments, got)
+	}
+
+	if err := cache.ReplaceFunc("missing", func(old any) (any, error) { return old, nil }); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+
+	fnErr := errors.New("refused")
+	err = cache.ReplaceFunc("foo", func(old any) (any, error) { return nil, fnErr })
+	if !errors.Is(err, fnErr) {
+		t.Errorf("expected %v but got %v", fnErr, err)
+	}
+	if got, _ := cache.Get("foo"); got != workers*increments {
+		t.Errorf("expected a failed fn to leave the value unchanged but got %v", got)
+	}
+}
+
+func Test_EventLog(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("event log", time.Minute, WithEventLog(3))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := cache.Add("foo", 1); err != nil {
+		t.Error(err)
+	}
+	if got := cache.History(); len(got) != 1 || got[0].Op != "add" || got[0].Key != "foo" {
+		t.Errorf("expected a single add event but got %v", got)
+	}
+
+	cache.Get("foo")
+	if err := cache.Replace("foo", 2); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Remove("foo"); err != nil {
+		t.Error(err)
+	}
+
+	var got []string
+	for _, e := range cache.History() {
+		got = append(got, e.Op+" "+e.Key)
+	}
+	want := []string{"get foo", "replace foo", "remove foo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	plain, _ := store.NewCache("no event log", time.Minute)
+	plain.Get("foo")
+	if plain.History() != nil {
+		t.Error("expected no history without an event log")
+	}
+}
+
+func Test_MustUse(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("must use", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if got := store.MustUse("must use"); got != cache {
+		t.Error("expected MustUse to return the existing cache")
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Error("expected MustUse to panic for a missing namespace")
+		}
+		if msg, ok := r.(string); !ok || !strings.Contains(msg, "missing") {
+			t.Errorf("expected a panic message naming the namespace but got %v", r)
+		}
+	}()
+	store.MustUse("missing")
+}
+
+func Test_RunJanitor(t *testing.T) {
+	store := NewStore(uuid())
+	if _, err := store.NewCache("janitor", time.Millisecond*10); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		store.RunJanitor(ctx, time.Millisecond*10)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for store.Size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if store.Size() != 0 {
+		t.Errorf("expected the janitor to remove the expired namespace but got a size of %d", store.Size())
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected RunJanitor to return after cancel")
+	}
+}
+
+func Test_RunJanitorInterval(t *testing.T) {
+	store := NewStore(uuid())
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := store.RunJanitor(context.Background(), interval); err == nil {
+			t.Errorf("expected an error for an interval of %s", interval)
+		}
+	}
+}
+
+func Test_DiffKeys(t *testing.T) {
+	store := NewStore(uuid())
+	a, _ := store.NewCache("a", time.Minute)
+	b, _ := store.NewCache("b", time.Minute)
+
+	for k, v := range map[string]any{"foo": 1, "bar": []int{1, 2}, "only a": 3} {
+		if err := a.Add(k, v); err != nil {
+			t.Error(err)
+		}
+	}
+	for k, v := range map[string]any{"foo": 1, "bar": []int{1, 2}, "only b": 4} {
+		if err := b.Add(k, v); err != nil {
+			t.Error(err)
+		}
+	}
+
+	onlyA, onlyB, both := a.DiffKeys(b)
+	if !reflect.DeepEqual(onlyA, []string{"only a"}) {
+		t.Errorf("expected [only a] but got %v", onlyA)
+	}
+	if !reflect.DeepEqual(onlyB, []string{"only b"}) {
+		t.Errorf("expected [only b] but got %v", onlyB)
+	}
+	if !reflect.DeepEqual(both, []string{"bar", "foo"}) {
+		t.Errorf("expected [bar foo] but got %v", both)
+	}
+
+	if a.EqualValues(b) {
+		t.Error("expected caches with different keys to differ")
+	}
+	if err := a.Remove("only a"); err != nil {
+		t.Error(err)
+	}
+	if err := b.Remove("only b"); err != nil {
+		t.Error(err)
+	}
+	if !a.EqualValues(b) {
+		t.Error("expected caches with the same entries to be equal")
+	}
+	if err := b.Replace("bar", []int{2, 1}); err != nil {
+		t.Error(err)
+	}
+	if a.EqualValues(b) {
+		t.Error("expected caches with different values to differ")
+	}
+}
+
+func Test_BloomFilter(t *testing.T) {
+	store := NewStore(uuid())
+	cache, err := store.NewCache("bloom", time.Minute, WithBloomFilter(1000, 0.01))
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if err := cache.Add(fmt.Sprintf("present %d", i), i); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		got, exists := cache.Get(fmt.Sprintf("present %d", i))
+		if !exists {
+			t.Fatalf("expected present %d to exist", i)
+		}
+		if got != i {
+			t.Errorf("expected %v but got %v", i, got)
+		}
+	}
+	if skipped := cache.bloom.skipped.Load(); skipped != 0 {
+		t.Errorf("expected no present keys to be skipped but got %d", skipped)
+	}
+
+	misses := 1000
+	for i := 0; i < misses; i++ {
+		if _, exists := cache.Get(fmt.Sprintf("absent %d", i)); exists {
+			t.Errorf("expected absent %d to be missing", i)
+		}
+	}
+	if skipped := cache.bloom.skipped.Load(); skipped < uint64(misses*9/10) {
+		t.Errorf("expected most misses to be answered by the filter but got %d of %d", skipped, misses)
+	}
+
+	if err := cache.RenameKey("present 0", "renamed"); err != nil {
+		t.Error(err)
+	}
+	if _, exists := cache.Get("renamed"); !exists {
+		t.Error("expected renamed key to pass the filter")
+	}
+}
+
+func Test_StoreMarshalJSON(t *testing.T) {
+	data := map[string]map[string]any{
+		"namespace test 1": {"foo": "1", "bar": "2"},
+		"namespace test 2": {"baz": "3"},
+	}
+	store, err := NewStoreFromMap("json store", data, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		ID         string                    `json:"id"`
+		Namespaces map[string]map[string]any `json:"namespaces"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "json store" {
+		t.Errorf("expected id %s but got %s", "json store", got.ID)
+	}
+	if !reflect.DeepEqual(got.Namespaces, data) {
+		t.Errorf("expected %v but got %v", data, got.Namespaces)
+	}
+
+	again, err := json.Marshal(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, again) {
+		t.Error("expected a stable encoding")
+	}
+
+	cache := store.MustUse("namespace test 2")
+	if err := cache.Add("bad", make(chan int)); err != nil {
+		t.Error(err)
+	}
+	_, err = json.Marshal(store)
+	if err == nil || !strings.Contains(err.Error(), "namespace test 2/bad") {
+		t.Errorf("expected an error naming the offending path but got %v", err)
+	}
+}
+
+type equalityUser struct {
+	ID   int
+	Name string
+}
+
+func Test_CompareAndSwap(t *testing.T) {
+	store := NewStore("cas store")
+	cache, _ := store.NewCache("cas", time.Minute)
+	if err := cache.Add("foo", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	swapped, err := cache.CompareAndSwap("foo", 2, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if swapped {
+		t.Error("expected swap with a stale old value to fail")
+	}
+	swapped, err = cache.CompareAndSwap("foo", 1, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if !swapped {
+		t.Error("expected swap to succeed")
+	}
+	if v, _ := cache.Get("foo"); v != 3 {
+		t.Errorf("expected %v but got %v", 3, v)
+	}
+	if _, err := cache.CompareAndSwap("missing", 1, 2); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+
+	byID, _ := store.NewCache("by id", time.Minute, WithEquality(func(a, b any) bool {
+		x, ok := a.(*equalityUser)
+		y, ok2 := b.(*equalityUser)
+		return ok && ok2 && x.ID == y.ID
+	}))
+	if err := byID.Add("user", &equalityUser{ID: 1, Name: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	swapped, err = byID.CompareAndSwap("user", &equalityUser{ID: 1, Name: "other"}, &equalityUser{ID: 1, Name: "new"})
+	if err != nil {
+		t.Error(err)
+	}
+	if !swapped {
+		t.Error("expected swap to succeed when the comparator matches by ID")
+	}
+	v, _ := byID.Get("user")
+	if u := v.(*equalityUser); u.Name != "new" {
+		t.Errorf("expected %s but got %s", "new", u.Name)
+	}
+	swapped, _ = byID.CompareAndSwap("user", &equalityUser{ID: 2, Name: "new"}, &equalityUser{ID: 3})
+	if swapped {
+		t.Error("expected swap to fail when the comparator rejects the old value")
+	}
+}
+
+func Test_Peek(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore("peek store", WithClock(clock), WithStats())
+	cache, _ := store.NewCache("peek", time.Minute, WithEventLog(10))
+	if err := cache.Add("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	added, _ := cache.LastAccess("foo")
+
+	clock.Advance(time.Second)
+	v, ok := cache.Peek("foo")
+	if !ok || v != "bar" {
+		t.Errorf("expected %v but got %v", "bar", v)
+	}
+	if _, ok := cache.Peek("missing"); ok {
+		t.Error("expected missing key to not be found")
+	}
+	if last, _ := cache.LastAccess("foo"); !last.Equal(added) {
+		t.Errorf("expected last access %v but got %v", added, last)
+	}
+	if stats := cache.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("expected no hits or misses but got %+v", stats)
+	}
+	if n := len(cache.History()); n != 1 {
+		t.Errorf("expected %d events but got %d", 1, n)
+	}
+
+	cache.Get("foo")
+	if last, _ := cache.LastAccess("foo"); !last.Equal(clock.Now()) {
+		t.Errorf("expected last access %v but got %v", clock.Now(), last)
+	}
+	if stats := cache.Stats(); stats.Hits != 1 {
+		t.Errorf("expected %d hits but got %d", 1, stats.Hits)
+	}
+}
+
+func Test_ExpirePolicy(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+
+	deleting := NewStore("delete store", WithClock(clock))
+	if _, err := deleting.NewCache("foo", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	emptying := NewStore("empty store", WithClock(clock), WithExpirePolicy(EmptyNamespace))
+	kept, err := emptying.NewCache("foo", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Minute)
+
+	n, err := deleting.Sweep()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 1 {
+		t.Errorf("expected %d expired but got %d", 1, n)
+	}
+	if deleting.Has("foo") {
+		t.Error("expected namespace to be removed")
+	}
+
+	n, err = emptying.Sweep()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 1 {
+		t.Errorf("expected %d expired but got %d", 1, n)
+	}
+	cache, err := emptying.UseNamespace("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache != kept {
+		t.Error("expected the same *Cache to be kept")
+	}
+	if cache.Size() != 0 {
+		t.Errorf("expected an empty cache but got %d entries", cache.Size())
+	}
+	if got := cache.expiry(); !got.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("expected expiry %v but got %v", clock.Now().Add(time.Minute), got)
+	}
+	if err := kept.Add("bar", 1); err != nil {
+		t.Error(err)
+	}
+	if n, _ := emptying.Sweep(); n != 0 {
+		t.Errorf("expected %d expired but got %d", 0, n)
+	}
+}
+
+func Test_SetMany(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore("set many store", WithClock(clock))
+	cache, _ := store.NewCache("set many", time.Hour)
+	if err := cache.Add("short", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := cache.SetMany(map[string]ItemWithTTL{
+		"short":   {Value: "new", TTL: time.Second},
+		"medium":  {Value: 2, TTL: time.Minute},
+		"long":    {Value: 3, TTL: 10 * time.Minute},
+		"forever": {Value: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := cache.Get("short"); v != "new" {
+		t.Errorf("expected %v but got %v", "new", v)
+	}
+
+	keys := func() []string {
+		var keys []string
+		for _, e := range cache.Entries() {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+
+	steps := []struct {
+		advance time.Duration
+		want    []string
+	}{
+		{0, []string{"forever", "long", "medium", "short"}},
+		{time.Second, []string{"forever", "long", "medium"}},
+		{time.Minute, []string{"forever", "long"}},
+		{10 * time.Minute, []string{"forever"}},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		if got := keys(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("expected %v but got %v", step.want, got)
+		}
+	}
+
+	limited := NewStore("limited store", WithMaxValueBytes(4))
+	small, _ := limited.NewCache("small", time.Hour)
+	err = small.SetMany(map[string]ItemWithTTL{
+		"ok":  {Value: "ok"},
+		"big": {Value: "much too large"},
+	})
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected %v but got %v", ErrValueTooLarge, err)
+	}
+	if small.Size() != 0 {
+		t.Errorf("expected nothing written but got %d entries", small.Size())
+	}
+}
+
+func Test_NamespaceHooks(t *testing.T) {
+	store := NewStore("hook store")
+	var created, removed []string
+	store.OnNamespaceCreate(func(namespace string) {
+		if !store.Has(namespace) {
+			t.Errorf("expected %s to exist when the create hook runs", namespace)
+		}
+		created = append(created, namespace)
+	})
+	store.OnNamespaceRemove(func(namespace string) {
+		if store.Has(namespace) {
+			t.Errorf("expected %s to be gone when the remove hook runs", namespace)
+		}
+		removed = append(removed, namespace)
+	})
+
+	for _, namespace := range []string{"foo", "bar", "baz"} {
+		if _, err := store.NewCache(namespace, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.MustUse("baz").Add("key", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove("foo"); err != nil {
+		t.Error(err)
+	}
+	if err := store.Remove("missing"); err == nil {
+		t.Error("expected an error removing a missing namespace")
+	}
+	if n := store.RemoveEmpty(); n != 1 {
+		t.Errorf("expected %d removed but got %d", 1, n)
+	}
+
+	if want := []string{"foo", "bar", "baz"}; !reflect.DeepEqual(created, want) {
+		t.Errorf("expected %v but got %v", want, created)
+	}
+	if want := []string{"foo", "bar"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("expected %v but got %v", want, removed)
+	}
+}
+
+func Test_CopyTo(t *testing.T) {
+	store := NewStore("copy store")
+	cache, _ := store.NewCache("copy", time.Minute)
+	want := map[string]any{"foo": 1, "bar": 2, "baz": 3}
+	for k, v := range want {
+		if err := cache.Add(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var copied []Entry
+	err := cache.CopyTo(func(key string, value any) error {
+		copied = append(copied, Entry{Key: key, Value: value})
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	got := make(map[string]any)
+	for _, e := range copied {
+		got[e.Key] = e.Value
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	errSink := errors.New("sink failed")
+	calls := 0
+	err = cache.CopyTo(func(key string, value any) error {
+		calls++
+		return errSink
+	})
+	if !errors.Is(err, errSink) {
+		t.Errorf("expected %v but got %v", errSink, err)
+	}
+	if calls != 1 {
+		t.Errorf("expected copying to stop after %d call but got %d", 1, calls)
+	}
+}
+
+func Test_Compact(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore("compact store", WithClock(clock))
+	cache, _ := store.NewCache("compact", time.Hour)
+
+	for i := 0; i < 1000; i++ {
+		if err := cache.Add(fmt.Sprint(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if err := cache.Remove(fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Add("live", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.AddWithTTL("stale", 2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := cache.Add(fmt.Sprintf("concurrent %d %d", i, j), j); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	store.Compact()
+	wg.Wait()
+
+	if v, ok := cache.Get("live"); !ok || v != 1 {
+		t.Errorf("expected %v but got %v", 1, v)
+	}
+	if _, ok := cache.Get("stale"); ok {
+		t.Error("expected expired entry to be dropped")
+	}
+	if n := cache.Size(); n != 401 {
+		t.Errorf("expected %d entries but got %d", 401, n)
+	}
+}
+
+// BenchmarkCompact reports the heap retained by a cache that has been filled
+// and emptied, with and without compacting it
+func BenchmarkCompact(b *testing.B) {
+	retained := func(b *testing.B, compact bool) {
+		var total uint64
+		for i := 0; i < b.N; i++ {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			store := NewStore("compact bench")
+			cache, _ := store.NewCache("compact", time.Hour)
+			for j := 0; j < 100_000; j++ {
+				cache.Add(strconv.Itoa(j), j)
+			}
+			for j := 0; j < 100_000; j++ {
+				cache.Remove(strconv.Itoa(j))
+			}
+			if compact {
+				store.Compact()
+			}
+
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			if after.HeapAlloc > before.HeapAlloc {
+				total += after.HeapAlloc - before.HeapAlloc
+			}
+			runtime.KeepAlive(store)
+		}
+		b.ReportMetric(float64(total)/float64(b.N), "retained-B")
+	}
+	b.Run("without", func(b *testing.B) { retained(b, false) })
+	b.Run("with", func(b *testing.B) { retained(b, true) })
+}
+
+// sweepLinear is the scan Sweep used before the expiry index: it checks
+// every namespace in the store
+func sweepLinear(s *Store) int {
+	removed := 0
+	for _, namespace := range s.Namespaces() {
+		cache, err := s.UseNamespace(namespace)
+		if err != nil {
+			continue
+		}
+		if isCacheExpired(cache) && s.Remove(namespace) == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+func Test_SweepIndex(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	build := func() *Store {
+		store := NewStore("index store", WithClock(clock))
+		for i := 0; i < 50; i++ {
+			cache, err := store.NewCache(fmt.Sprint(i), time.Duration(i)*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%7 == 0 {
+				if err := cache.Add("keep", i); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if i%5 == 0 {
+				cache.SetExpiry(clock.Now().Add(time.Hour))
+			}
+			if i%11 == 0 {
+				cache.SetExpiry(clock.Now())
+			}
+		}
+		if err := store.Remove("3"); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+
+	indexed, linear := build(), build()
+	for _, step := range []time.Duration{0, 10 * time.Second, 25 * time.Second, time.Hour} {
+		clock.Advance(step)
+		got, err := indexed.Sweep()
+		if err != nil {
+			t.Error(err)
+		}
+		want := sweepLinear(linear)
+		if got != want {
+			t.Errorf("expected %d removed but got %d", want, got)
+		}
+		if !reflect.DeepEqual(indexed.Namespaces(), linear.Namespaces()) {
+			t.Errorf("expected %v but got %v", linear.Namespaces(), indexed.Namespaces())
+		}
+	}
+
+	cache := indexed.MustUse("7")
+	if err := cache.Remove("keep"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := indexed.Sweep(); n != 1 {
+		t.Errorf("expected a namespace emptied after its deadline to be swept but got %d", n)
+	}
+}
+
+func benchmarkSweep(b *testing.B, sweep func(s *Store)) {
+	store := NewStore("sweep bench")
+	for i := 0; i < 10_000; i++ {
+		if _, err := store.NewCache(fmt.Sprint(i), time.Hour); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 10; j++ {
+			if _, err := store.NewCache(fmt.Sprintf("due %d", j), -time.Second); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		sweep(store)
+	}
+}
+
+func BenchmarkSweep(b *testing.B) {
+	b.Run("indexed", func(b *testing.B) {
+		benchmarkSweep(b, func(s *Store) { s.Sweep() })
+	})
+	b.Run("linear", func(b *testing.B) {
+		benchmarkSweep(b, func(s *Store) { sweepLinear(s) })
+	})
+}
+
+func Test_GetMulti(t *testing.T) {
+	store := NewStore("multi store", WithStats())
+	cache, _ := store.NewCache("multi", time.Minute)
+	for i := 0; i < 10; i++ {
+		if err := cache.Add(fmt.Sprint(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := cache.GetMulti("1", "3", "5", "missing", "3")
+	want := map[string]any{"1": 1, "3": 3, "5": 5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+	if stats := cache.Stats(); stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("expected 3 hits and 1 miss but got %+v", stats)
+	}
+	if got := cache.GetMulti(); len(got) != 0 {
+		t.Errorf("expected an empty result but got %v", got)
+	}
+}
+
+func benchmarkGetMultiCache(b *testing.B) (*Cache, []string) {
+	store := NewStore("multi bench")
+	cache, _ := store.NewCache("multi", time.Hour)
+	keys := make([]string, 0, 10_000)
+	for i := 0; i < 10_000; i++ {
+		key := strconv.Itoa(i)
+		cache.Add(key, i)
+		if i%10 != 0 {
+			keys = append(keys, key)
+		}
+	}
+	b.ResetTimer()
+	return cache, keys
+}
+
+func BenchmarkGetMulti(b *testing.B) {
+	b.Run("GetMulti", func(b *testing.B) {
+		cache, keys := benchmarkGetMultiCache(b)
+		for i := 0; i < b.N; i++ {
+			cache.GetMulti(keys...)
+		}
+	})
+	b.Run("Get", func(b *testing.B) {
+		cache, keys := benchmarkGetMultiCache(b)
+		for i := 0; i < b.N; i++ {
+			result := make(map[string]any, len(keys))
+			for _, key := range keys {
+				if v, ok := cache.Get(key); ok {
+					result[key] = v
+				}
+			}
+		}
+	})
+}
+
+func Test_RejectNil(t *testing.T) {
+	var nilPointer *equalityUser
+
+	strict := NewStore("strict store", WithRejectNil())
+	cache, _ := strict.NewCache("strict", time.Minute)
+	if err := cache.Add("nil", nil); !errors.Is(err, ErrNilValue) {
+		t.Errorf("expected %v but got %v", ErrNilValue, err)
+	}
+	if err := cache.Add("nil pointer", nilPointer); !errors.Is(err, ErrNilValue) {
+		t.Errorf("expected %v but got %v", ErrNilValue, err)
+	}
+	if err := cache.Add("zero", 0); err != nil {
+		t.Errorf("expected a zero value to be accepted but got %v", err)
+	}
+	if err := cache.Replace("zero", nil); !errors.Is(err, ErrNilValue) {
+		t.Errorf("expected %v but got %v", ErrNilValue, err)
+	}
+	if cache.Size() != 1 {
+		t.Errorf("expected %d entry but got %d", 1, cache.Size())
+	}
+
+	permissive := NewStore("permissive store")
+	cache, _ = permissive.NewCache("permissive", time.Minute)
+	if err := cache.Add("nil", nil); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Add("nil pointer", nilPointer); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Transaction(t *testing.T) {
+	data := map[string]map[string]any{
+		"accounts": {"alice": 100, "bob": 50},
+		"ledger":   {},
+	}
+	store, err := NewStoreFromMap("tx store", data, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	err = store.Transaction(func(tx *Tx) error {
+		if err := tx.Replace("accounts", "alice", 0); err != nil {
+			return err
+		}
+		if err := tx.Add("ledger", "entry 1", 100); err != nil {
+			return err
+		}
+		if err := tx.Remove("accounts", "bob"); err != nil {
+			return err
+		}
+		if v, _ := tx.Get("accounts", "alice"); v != 0 {
+			t.Errorf("expected the tx to read its own write but got %v", v)
+		}
+		if _, ok := tx.Get("accounts", "bob"); ok {
+			t.Error("expected the tx to read its own remove")
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Errorf("expected %v but got %v", errAbort, err)
+	}
+	got := map[string]map[string]any{
+		"accounts": store.MustUse("accounts").GetMulti("alice", "bob"),
+		"ledger":   store.MustUse("ledger").GetMulti("entry 1"),
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Errorf("expected no changes but got %v", got)
+	}
+
+	err = store.Transaction(func(tx *Tx) error {
+		if err := tx.Replace("accounts", "alice", 50); err != nil {
+			return err
+		}
+		if err := tx.Add("ledger", "entry 1", -50); err != nil {
+			return err
+		}
+		return tx.Add("accounts", "bob", 0)
+	})
+	if err == nil {
+		t.Error("expected an error adding an existing key")
+	}
+	if v, _ := store.MustUse("accounts").Get("alice"); v != 100 {
+		t.Errorf("expected %v but got %v", 100, v)
+	}
+
+	err = store.Transaction(func(tx *Tx) error {
+		if err := tx.Replace("accounts", "alice", 50); err != nil {
+			return err
+		}
+		if err := tx.Add("ledger", "entry 1", -50); err != nil {
+			return err
+		}
+		return store.MustUse("accounts").Replace("alice", 75)
+	})
+	if err == nil {
+		t.Error("expected a conflict when a key changes during the transaction")
+	}
+	if store.MustUse("ledger").Size() != 0 {
+		t.Error("expected no changes after a conflict")
+	}
+
+	err = store.Transaction(func(tx *Tx) error {
+		if err := tx.Replace("accounts", "alice", 25); err != nil {
+			return err
+		}
+		if err := tx.Remove("accounts", "bob"); err != nil {
+			return err
+		}
+		return tx.Add("ledger", "entry 1", -50)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]any{
+		"accounts": {"alice": 25},
+		"ledger":   {"entry 1": -50},
+	}
+	got = map[string]map[string]any{
+		"accounts": store.MustUse("accounts").GetMulti("alice", "bob"),
+		"ledger":   store.MustUse("ledger").GetMulti("entry 1"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+}
+
+func Test_ReplaceIfVersion(t *testing.T) {
+	store := NewStore("version store")
+	cache, _ := store.NewCache("version", time.Minute)
+	if err := cache.Add("foo", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_, version, err := cache.GetWithVersion("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var succeeded atomic.Int32
+	for i := 1; i <= 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := cache.ReplaceIfVersion("foo", i, version)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				succeeded.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := succeeded.Load(); n != 1 {
+		t.Errorf("expected exactly %d replace to succeed but got %d", 1, n)
+	}
+
+	v, next, err := cache.GetWithVersion("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= version {
+		t.Errorf("expected version to increase past %d but got %d", version, next)
+	}
+	if ok, _ := cache.ReplaceIfVersion("foo", 3, version); ok {
+		t.Error("expected a stale version to be rejected")
+	}
+	if got, _ := cache.Get("foo"); got != v {
+		t.Errorf("expected %v but got %v", v, got)
+	}
+	if _, _, err := cache.GetWithVersion("missing"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func Test_Dump(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore("dump store", WithClock(clock))
+	cache, _ := store.NewCache("dump", time.Hour)
+	if err := cache.Add("zeta", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.AddWithTTL("alpha", "short lived", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Add("mid", []int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := cache.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected %d lines but got %d:\n%s", 4, len(lines), buf.String())
+	}
+	want := [][]string{
+		{"KEY", "VALUE", "TTL"},
+		{"alpha", "short lived", "1m0s"},
+		{"mid", "[1 2]", "1h0m0s"},
+		{"zeta", "1", "1h0m0s"},
+	}
+	for i, line := range lines {
+		for _, field := range want[i] {
+			if !strings.Contains(line, field) {
+				t.Errorf("expected line %q to contain %q", line, field)
+			}
+		}
+		if !strings.HasPrefix(line, want[i][0]) {
+			t.Errorf("expected line %q to start with %q", line, want[i][0])
+		}
+	}
+	if col := strings.Index(lines[0], "TTL"); strings.Index(lines[1], "1m0s") != col {
+		t.Errorf("expected TTL column to be aligned:\n%s", buf.String())
+	}
+}
+
+func Test_SetDefaultTTL(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore("default ttl store", WithClock(clock))
+	foo, _ := store.NewCache("foo", time.Hour)
+	bar, _ := store.NewCache("bar", time.Hour)
+
+	if err := foo.Add("forever", 1); err != nil {
+		t.Fatal(err)
+	}
+	store.SetDefaultTTL(time.Minute)
+	if err := foo.Add("minute", 2); err != nil {
+		t.Fatal(err)
+	}
+	store.SetDefaultTTL(10 * time.Minute)
+	if err := foo.Add("ten minutes", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := bar.Add("ten minutes", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := foo.AddWithTTL("explicit", 5, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := foo.MapWithMeta()
+	want := map[string]time.Time{
+		"forever":     {},
+		"minute":      clock.Now().Add(time.Minute),
+		"ten minutes": clock.Now().Add(10 * time.Minute),
+		"explicit":    clock.Now().Add(time.Second),
+	}
+	for key, expires := range want {
+		if got := meta[key].ExpiresAt; !got.Equal(expires) {
+			t.Errorf("expected %s to expire at %v but got %v", key, expires, got)
+		}
+	}
+	if got := bar.MapWithMeta()["ten minutes"].ExpiresAt; !got.Equal(clock.Now().Add(10 * time.Minute)) {
+		t.Errorf("expected the default to apply to every namespace but got %v", got)
+	}
+}
+
+func Test_TrimTo(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore("trim store", WithClock(clock))
+	cache, _ := store.NewCache("trim", time.Hour)
+	for i := 0; i < 10; i++ {
+		if err := cache.Add(fmt.Sprint(i), i); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Second)
+	}
+	for _, key := range []string{"2", "0", "5"} {
+		cache.Get(key)
+		clock.Advance(time.Second)
+	}
+
+	if n := cache.TrimTo(20); n != 0 {
+		t.Errorf("expected %d removed but got %d", 0, n)
+	}
+	if n := cache.TrimTo(4); n != 6 {
+		t.Errorf("expected %d removed but got %d", 6, n)
+	}
+	var keys []string
+	for _, e := range cache.Entries() {
+		keys = append(keys, e.Key)
+	}
+	if want := []string{"0", "2", "5", "9"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected %v but got %v", want, keys)
+	}
+}
+
+func Test_NewStoreWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := NewStoreWithContext(ctx, uuid())
+	if store.Closed() {
+		t.Error("expected a new store to be open")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		store.RunJanitor(context.Background(), time.Millisecond*10)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected RunJanitor to return after the store's context is canceled")
+	}
+	if !store.Closed() {
+		t.Error("expected the store to be closed")
+	}
+	store.Close()
+}
+
+func Test_Merge(t *testing.T) {
+	setup := func() (*Cache, *Cache) {
+		store := NewStore(uuid())
+		dst, _ := store.NewCache("dst", time.Minute)
+		src, _ := store.NewCache("src", time.Minute)
+		for k, v := range map[string]any{"foo": 1, "bar": 2} {
+			if err := dst.Add(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for k, v := range map[string]any{"foo": 10, "bar": 20, "baz": 30} {
+			if err := src.Add(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dst, src
+	}
+
+	tests := []struct {
+		policy  ConflictPolicy
+		applied int
+		want    map[string]any
+	}{
+		{MergeSkip, 1, map[string]any{"foo": 1, "bar": 2, "baz": 30}},
+		{MergeOverwrite, 3, map[string]any{"foo": 10, "bar": 20, "baz": 30}},
+	}
+	for _, tt := range tests {
+		dst, src := setup()
+		applied, err := dst.Merge(src, tt.policy)
+		if err != nil {
+			t.Error(err)
+		}
+		if applied != tt.applied {
+			t.Errorf("expected %d applied but got %d", tt.applied, applied)
+		}
+		if got, _ := dst.Map(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expected %v but got %v", tt.want, got)
+		}
+	}
+
+	dst, src := setup()
+	applied, err := dst.Merge(src, MergeError)
+	if err == nil {
+		t.Fatal("expected an error for conflicting keys")
+	}
+	if !strings.Contains(err.Error(), "bar, foo") {
+		t.Errorf("expected the error to list the conflicting keys but got %v", err)
+	}
+	if applied != 0 || dst.Size() != 2 {
+		t.Errorf("expected nothing applied but got %d applied and %d entries", applied, dst.Size())
+	}
+
+	if err := src.Remove("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Remove("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := dst.Merge(src, MergeError); err != nil || applied != 1 {
+		t.Errorf("expected 1 applied without conflicts but got %d, %v", applied, err)
+	}
+}
+
+func Test_LazyExpiration(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore("lazy store", WithClock(clock), WithStats())
+	cache, _ := store.NewCache("lazy", time.Minute)
+	if err := cache.AddWithTTL("short", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.AddWithTTL("other", 2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Add("long", 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.NewCache("empty", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := cache.Get("short"); !ok || v != 1 {
+		t.Errorf("expected %v before the deadline but got %v", 1, v)
+	}
+	clock.Advance(time.Second)
+
+	if v, ok := cache.Get("short"); ok {
+		t.Errorf("expected a miss after the deadline but got %v", v)
+	}
+	if _, ok := cache.Peek("short"); ok {
+		t.Error("expected the expired entry to be removed")
+	}
+	if got := cache.GetMulti("other", "long"); !reflect.DeepEqual(got, map[string]any{"long": 3}) {
+		t.Errorf("expected only the live key but got %v", got)
+	}
+	if _, ok := cache.Peek("other"); ok {
+		t.Error("expected the expired entry to be removed")
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 2 {
+		t.Errorf("expected 2 hits and 2 misses but got %+v", stats)
+	}
+
+	if !store.Has("empty") {
+		t.Error("expected the namespace to exist before its deadline")
+	}
+	clock.Advance(time.Minute)
+	if store.Has("empty") {
+		t.Error("expected an expired namespace to be reported missing")
+	}
+	if !reflect.DeepEqual(store.Namespaces(), []string{"lazy"}) {
+		t.Errorf("expected the expired namespace to be removed but got %v", store.Namespaces())
+	}
+	if !store.Has("lazy") {
+		t.Error("expected a namespace with entries to survive its deadline")
+	}
+}
+
+func Test_ValueTransform(t *testing.T) {
+	errOdd := errors.New("odd stored value")
+	double := func(v any) (any, error) {
+		n, ok := v.(int)
+		if !ok {
+			return nil, fmt.Errorf("cannot encode %T", v)
+		}
+		return n * 2, nil
+	}
+	halve := func(v any) (any, error) {
+		n := v.(int)
+		if n%2 != 0 {
+			return nil, errOdd
+		}
+		return n / 2, nil
+	}
+
+	store := NewStore("transform store")
+	cache, _ := store.NewCache("transform", time.Minute, WithValueTransform(double, halve))
+	if err := cache.Add("foo", 21); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := cache.Get("foo"); !ok || v != 21 {
+		t.Errorf("expected %v but got %v", 21, v)
+	}
+	if stored, _ := cache.storage.Load("foo"); stored.(*entry).value != 42 {
+		t.Errorf("expected the stored value %v but got %v", 42, stored.(*entry).value)
+	}
+	if v := cache.MapWithMeta()["foo"].Value; v != 21 {
+		t.Errorf("expected MapWithMeta to decode %v but got %v", 21, v)
+	}
+	if e := cache.SortedEntries(); len(e) != 1 || e[0].Value != 21 {
+		t.Errorf("expected SortedEntries to decode %v but got %v", 21, e)
+	}
+	if m, _ := cache.Map(); m["foo"] != 21 {
+		t.Errorf("expected Map to decode %v but got %v", 21, m["foo"])
+	}
+
+	if err := cache.Replace("foo", 5); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := cache.Get("foo"); !ok || v != 5 {
+		t.Errorf("expected %v but got %v", 5, v)
+	}
+	if stored, _ := cache.storage.Load("foo"); stored.(*entry).value != 10 {
+		t.Errorf("expected the stored value %v but got %v", 10, stored.(*entry).value)
+	}
+
+	if err := cache.Add("bar", "not an int"); err == nil {
+		t.Error("expected the encode error to propagate from Add")
+	}
+	if err := cache.Replace("foo", "not an int"); err == nil {
+		t.Error("expected the encode error to propagate from Replace")
+	}
+
+	cache.storage.Store("odd", newEntry(7, time.Time{}, time.Now(), time.Now()))
+	if v, ok := cache.Get("odd"); ok {
+		t.Errorf("expected a value that fails to decode to be a miss but got %v", v)
+	}
+	if _, _, err := cache.GetWithVersion("odd"); !errors.Is(err, errOdd) {
+		t.Errorf("expected %v but got %v", errOdd, err)
+	}
+	if _, err := cache.Map(); !errors.Is(err, errOdd) {
+		t.Errorf("expected Map to report %v but got %v", errOdd, err)
+	}
+}
+
+func Test_NamespacesBySize(t *testing.T) {
+	store := NewStore(uuid())
+	for namespace, n := range map[string]int{"small": 1, "large": 5, "medium": 3, "also medium": 3, "empty": 0} {
+		cache, err := store.NewCache(namespace, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := cache.Add(fmt.Sprint(i), i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	want := []NamespaceSize{
+		{Namespace: "large", Entries: 5},
+		{Namespace: "also medium", Entries: 3},
+		{Namespace: "medium", Entries: 3},
+		{Namespace: "small", Entries: 1},
+		{Namespace: "empty", Entries: 0},
+	}
+	if got := store.NamespacesBySize(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+}
+
+func Test_StoreConcurrentReads(t *testing.T) {
+	store := NewStore(uuid())
+	for i := 0; i < 10; i++ {
+		if _, err := store.NewCache(fmt.Sprint(i), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				namespace := fmt.Sprint(j % 10)
+				if _, err := store.UseNamespace(namespace); err != nil {
+					t.Error(err)
+				}
+				store.Has(namespace)
+				store.Namespaces()
+				store.Size()
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 50; j++ {
+			namespace := fmt.Sprintf("writer %d", j)
+			if _, err := store.NewCache(namespace, time.Minute); err != nil {
+				t.Error(err)
+			}
+			if err := store.Remove(namespace); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if store.Size() != 10 {
+		t.Errorf("expected %d namespaces but got %d", 10, store.Size())
+	}
+}
+
+func BenchmarkStoreConcurrentReads(b *testing.B) {
+	store := NewStore(uuid())
+	for i := 0; i < 100; i++ {
+		store.NewCache(fmt.Sprint(i), time.Hour)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			store.UseNamespace(strconv.Itoa(i % 100))
+			store.Has(strconv.Itoa(i % 100))
+			i++
+		}
+	})
+}
+
+func Test_ExpiresAt(t *testing.T) {
+	store := NewStore(uuid())
+	before := time.Now()
+	cache, _ := store.NewCache("expires at", time.Minute)
+	after := time.Now()
+
+	got := cache.ExpiresAt()
+	if got.Before(before.Add(time.Minute)) || got.After(after.Add(time.Minute)) {
+		t.Errorf("expected about %v but got %v", before.Add(time.Minute), got)
+	}
+
+	deadline := time.Now().Add(time.Hour)
+	cache.SetExpiry(deadline)
+	if got := cache.ExpiresAt(); !got.Equal(deadline) {
+		t.Errorf("expected %v but got %v", deadline, got)
+	}
+}
+
+func Test_AsyncGet(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("async", time.Minute)
+	for i := 0; i < 5; i++ {
+		if err := cache.Add(fmt.Sprint(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	futures := make(map[string]<-chan Result)
+	for _, key := range []string{"0", "1", "2", "3", "4", "missing"} {
+		futures[key] = cache.AsyncGet(key)
+	}
+	for key, future := range futures {
+		result, ok := <-future
+		if !ok {
+			t.Fatalf("expected a result for %s", key)
+		}
+		if key == "missing" {
+			if result.Err == nil {
+				t.Error("expected an error for a missing key")
+			}
+		} else if result.Err != nil || fmt.Sprint(result.Value) != key {
+			t.Errorf("expected %s but got %v, %v", key, result.Value, result.Err)
+		}
+		if _, ok := <-future; ok {
+			t.Errorf("expected the channel for %s to be closed after delivery", key)
+		}
+	}
+}
+
+func Test_StoreKeys(t *testing.T) {
+	store := NewStore(uuid())
+	if keys := store.Keys("/"); len(keys) != 0 {
+		t.Errorf("expected no keys but got %v", keys)
+	}
+
+	data := map[string]map[string]any{
+		"users":  {"bob": 1, "alice": 2},
+		"groups": {"admin": 3},
+	}
+	store, err := NewStoreFromMap(uuid(), data, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.NewCache("empty", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"groups/admin", "users/alice", "users/bob"}
+	if got := store.Keys("/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+}
+
+func Test_NamespaceNormalizer(t *testing.T) {
+	store := NewStore(uuid(), WithNamespaceNormalizer(strings.ToLower))
+	tenant, err := store.NewCache("Tenant", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.Add("foo", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"tenant", "TENANT", "Tenant"} {
+		cache, err := store.UseNamespace(name)
+		if err != nil {
+			t.Errorf("expected %s to resolve but got %v", name, err)
+			continue
+		}
+		if cache != tenant {
+			t.Errorf("expected %s to resolve to the same cache", name)
+		}
+		if !store.Has(name) {
+			t.Errorf("expected %s to exist", name)
+		}
+	}
+	if !reflect.DeepEqual(store.Namespaces(), []string{"tenant"}) {
+		t.Errorf("expected a single normalized namespace but got %v", store.Namespaces())
+	}
+
+	if err := store.Remove("TeNaNt"); err != nil {
+		t.Error(err)
+	}
+	if store.Size() != 0 {
+		t.Errorf("expected an empty store but got %d namespaces", store.Size())
+	}
+}
+
+func Test_ExpireAfter(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	cache, _ := store.NewCache("expire after", time.Hour)
+	if err := cache.AddWithTTL("foo", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Add("bar", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.ExpireAfter("foo", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	if v, ok := cache.Get("foo"); !ok || v != 1 {
+		t.Errorf("expected the extended key to survive but got %v", v)
+	}
+
+	if err := cache.ExpireAfter("bar", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond)
+	if _, ok := cache.Get("bar"); ok {
+		t.Error("expected the shortened key to be a miss")
+	}
+
+	if err := cache.ExpireAfter("foo", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get("foo"); ok {
+		t.Error("expected a negative ttl to expire the key immediately")
+	}
+	if err := cache.ExpireAfter("missing", time.Second); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func Test_StoreLoad(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func() (any, error) {
+		calls.Add(1)
+		<-release
+		return "loaded", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]any, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := store.Load("lazy", "foo", time.Minute, loader)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}(i)
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the loader to run %d time but it ran %d times", 1, n)
+	}
+	for _, v := range results {
+		if v != "loaded" {
+			t.Errorf("expected %v but got %v", "loaded", v)
+		}
+	}
+	if store.Size() != 1 {
+		t.Errorf("expected %d namespace but got %d", 1, store.Size())
+	}
+
+	v, err := store.Load("lazy", "foo", time.Minute, func() (any, error) {
+		t.Error("expected a hit without calling the loader")
+		return nil, nil
+	})
+	if err != nil || v != "loaded" {
+		t.Errorf("expected %v but got %v, %v", "loaded", v, err)
+	}
+
+	clock.Advance(time.Minute)
+	errLoad := errors.New("load failed")
+	if _, err := store.Load("lazy", "foo", time.Minute, func() (any, error) { return nil, errLoad }); !errors.Is(err, errLoad) {
+		t.Errorf("expected %v but got %v", errLoad, err)
+	}
+	if _, ok := store.MustUse("lazy").Peek("foo"); ok {
+		t.Error("expected nothing cached after a loader error")
+	}
+}
+
+func Test_Capacity(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("capacity", time.Minute, WithCapacityHint(64))
+
+	for i := 0; i < 50; i++ {
+		if err := cache.Add(strconv.Itoa(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i += 3 {
+		cache.Remove(strconv.Itoa(i))
+	}
+	if err := cache.Add("extra", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, bytes := cache.Capacity()
+	if entries != cache.Size() {
+		t.Errorf("expected %d entries but got %d", cache.Size(), entries)
+	}
+	if bytes <= 0 {
+		t.Errorf("expected a positive byte estimate but got %d", bytes)
+	}
+	mp, err := cache.Map()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mp) != entries {
+		t.Errorf("expected Map to hold %d entries but got %d", entries, len(mp))
+	}
+
+	var nilCache *Cache
+	if entries, bytes := nilCache.Capacity(); entries != 0 || bytes != 0 {
+		t.Errorf("expected a nil cache to report nothing but got %d, %d", entries, bytes)
+	}
+}
+
+func Test_NamespaceLabels(t *testing.T) {
+	store := NewStore(uuid())
+	for _, ns := range []string{"sessions", "users", "reports"} {
+		if _, err := store.NewCache(ns, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.SetNamespaceLabels("sessions", map[string]string{"tier": "hot"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetNamespaceLabels("users", map[string]string{"tier": "hot", "owner": "auth"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetNamespaceLabels("reports", map[string]string{"tier": "cold"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := store.NamespacesWithLabel("tier", "hot"); !reflect.DeepEqual(got, []string{"sessions", "users"}) {
+		t.Errorf("expected %v but got %v", []string{"sessions", "users"}, got)
+	}
+	if got := store.NamespacesWithLabel("owner", "auth"); !reflect.DeepEqual(got, []string{"users"}) {
+		t.Errorf("expected %v but got %v", []string{"users"}, got)
+	}
+	if got := store.NamespacesWithLabel("tier", "warm"); len(got) != 0 {
+		t.Errorf("expected no namespaces but got %v", got)
+	}
+
+	if err := store.SetNamespaceLabels("users", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.NamespacesWithLabel("tier", "hot"); !reflect.DeepEqual(got, []string{"sessions"}) {
+		t.Errorf("expected %v but got %v", []string{"sessions"}, got)
+	}
+	if err := store.SetNamespaceLabels("missing", map[string]string{"tier": "hot"}); err == nil {
+		t.Error("expected an error for a missing namespace")
+	}
+}
+
+func Test_RemoveExpired(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	cache, _ := store.NewCache("remove expired", time.Hour)
+
+	for i := 0; i < 5; i++ {
+		if err := cache.AddWithTTL("short"+strconv.Itoa(i), i, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := cache.AddWithTTL("long"+strconv.Itoa(i), i, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Add("forever", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := cache.RemoveExpired(); n != 0 {
+		t.Errorf("expected nothing removed before the deadline but got %d", n)
+	}
+	clock.Advance(time.Second)
+	if n := cache.RemoveExpired(); n != 5 {
+		t.Errorf("expected %d keys removed but got %d", 5, n)
+	}
+	if cache.Size() != 4 {
+		t.Errorf("expected %d keys left but got %d", 4, cache.Size())
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := cache.Peek("long" + strconv.Itoa(i)); !ok {
+			t.Errorf("expected long%d to survive", i)
+		}
+	}
+	if _, ok := cache.Peek("forever"); !ok {
+		t.Error("expected the key without a per-key ttl to survive")
+	}
+}
+
+func Test_SortedEntries(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("sorted", time.Minute)
+	for n := 0; n < 100; n++ {
+		i := n * 37 % 100 // insert out of order
+		if err := cache.Add(fmt.Sprintf("key%03d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := cache.SortedEntries()
+	if len(first) != 100 {
+		t.Fatalf("expected %d entries but got %d", 100, len(first))
+	}
+	for run := 0; run < 5; run++ {
+		entries := cache.SortedEntries()
+		for i := 1; i < len(entries); i++ {
+			if entries[i-1].Key >= entries[i].Key {
+				t.Fatalf("expected strictly sorted keys but %q came before %q", entries[i-1].Key, entries[i].Key)
+			}
+		}
+		if !reflect.DeepEqual(entries, first) {
+			t.Errorf("expected run %d to match the first run", run)
+		}
+	}
+}
+
+func Test_ReplaceTTL(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	store.SetDefaultTTL(time.Minute)
+	cache, _ := store.NewCache("replace ttl", time.Hour)
+
+	for _, key := range []string{"keep", "reset", "plain"} {
+		if err := cache.AddWithTTL(key, 1, 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(5 * time.Second)
+
+	if err := cache.ReplaceKeepTTL("keep", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.ReplaceResetTTL("reset", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Replace("plain", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	want := time.Unix(1010, 0)
+	for _, key := range []string{"keep", "plain"} {
+		if e := cache.MapWithMeta()[key]; !e.ExpiresAt.Equal(want) {
+			t.Errorf("expected %s to keep deadline %v but got %v", key, want, e.ExpiresAt)
+		}
+	}
+	if e := cache.MapWithMeta()["reset"]; !e.ExpiresAt.Equal(time.Unix(1065, 0)) {
+		t.Errorf("expected reset deadline %v but got %v", time.Unix(1065, 0), e.ExpiresAt)
+	}
+
+	clock.Advance(5 * time.Second)
+	if _, ok := cache.Get("keep"); ok {
+		t.Error("expected the kept ttl to expire")
+	}
+	if v, ok := cache.Get("reset"); !ok || v != 2 {
+		t.Errorf("expected the reset key to survive but got %v", v)
+	}
+	if err := cache.ReplaceResetTTL("missing", 1); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func Test_PurgeNamespace(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("purge", time.Minute)
+	for i := 0; i < 10; i++ {
+		if err := cache.Add(strconv.Itoa(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetNamespaceLabels("purge", map[string]string{"tier": "hot"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PurgeNamespace("purge"); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Has("purge") {
+		t.Error("expected the namespace to still exist")
+	}
+	if cache.Size() != 0 {
+		t.Errorf("expected the cache to be empty but got a size of %d", cache.Size())
+	}
+	if got := store.NamespacesWithLabel("tier", "hot"); !reflect.DeepEqual(got, []string{"purge"}) {
+		t.Errorf("expected the labels to survive but got %v", got)
+	}
+	if err := store.PurgeNamespace("missing"); err == nil {
+		t.Error("expected an error for a missing namespace")
+	}
+}
+
+func Test_PurgeConcurrent(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("purge concurrent", time.Minute)
+	for i := 0; i < 100; i++ {
+		if err := cache.Add("before"+strconv.Itoa(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged := make(chan struct{})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var after []string
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				select {
+				case <-purged:
+					key := fmt.Sprintf("after%d-%d", w, i)
+					if err := cache.Add(key, i); err != nil {
+						t.Error(err)
+					}
+					mu.Lock()
+					after = append(after, key)
+					mu.Unlock()
+				default:
+					_ = cache.Add(fmt.Sprintf("during%d-%d", w, i), i)
+				}
+			}
+		}(w)
+	}
+
+	for i := 0; i < 5; i++ {
+		cache.Purge()
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := cache.Peek("before" + strconv.Itoa(i)); ok {
+			t.Fatalf("expected before%d to be purged", i)
+		}
+	}
+	close(purged)
+	wg.Wait()
+
+	for _, key := range after {
+		if _, ok := cache.Peek(key); !ok {
+			t.Errorf("expected %s, written after the purge, to be kept", key)
+		}
+	}
+	cache.Purge()
+	if cache.Size() != 0 {
+		t.Errorf("expected an empty cache but got a size of %d", cache.Size())
+	}
+}
+
+func Test_StoreWalk(t *testing.T) {
+	store := NewStore(uuid())
+	want := make(map[[2]string]any)
+	for _, ns := range []string{"a", "b", "c"} {
+		cache, _ := store.NewCache(ns, time.Minute)
+		for i := 0; i < 5; i++ {
+			key := ns + strconv.Itoa(i)
+			if err := cache.Add(key, i); err != nil {
+				t.Fatal(err)
+			}
+			want[[2]string{ns, key}] = i
+		}
+	}
+
+	got := make(map[[2]string]any)
+	store.Walk(func(namespace, key string, value any) bool {
+		got[[2]string{namespace, key}] = value
+		return true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	visited := 0
+	store.Walk(func(namespace, key string, value any) bool {
+		visited++
+		return visited < 3
+	})
+	if visited != 3 {
+		t.Errorf("expected the walk to stop after %d entries but it visited %d", 3, visited)
+	}
+
+	// fn may use the store without deadlocking
+	store.Walk(func(namespace, key string, value any) bool {
+		store.Has(namespace)
+		return false
+	})
+}
+
+func Test_StoreExpired(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock), WithLifetime(time.Minute))
+
+	if store.Expired() {
+		t.Error("expected a new store not to be expired")
+	}
+	clock.Advance(time.Minute - time.Second)
+	if store.Expired() {
+		t.Error("expected the store not to be expired before its deadline")
+	}
+	clock.Advance(time.Second)
+	if !store.Expired() {
+		t.Error("expected the store to be expired at its deadline")
+	}
+
+	store.Renew(time.Hour)
+	if store.Expired() {
+		t.Error("expected a renewed store not to be expired")
+	}
+	clock.Advance(time.Hour)
+	if !store.Expired() {
+		t.Error("expected the renewed store to expire after the new deadline")
+	}
+
+	defaulted := NewStore(uuid(), WithClock(clock))
+	clock.Advance(30 * time.Second)
+	if !defaulted.Expired() {
+		t.Error("expected a store without a lifetime to expire after 30 seconds")
+	}
+}
+
+func Test_BatchReplace(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	cache, _ := store.NewCache("batch replace", time.Hour)
+	if err := cache.AddWithTTL("a", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Add("b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.AddWithTTL("stale", 3, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+
+	applied, missing, err := cache.BatchReplace(map[string]any{
+		"a":     10,
+		"b":     20,
+		"stale": 30,
+		"x":     40,
+		"y":     50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 2 {
+		t.Errorf("expected %d keys applied but got %d", 2, applied)
+	}
+	if want := []string{"stale", "x", "y"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("expected missing %v but got %v", want, missing)
+	}
+	if v, _ := cache.Get("a"); v != 10 {
+		t.Errorf("expected %v but got %v", 10, v)
+	}
+	if v, _ := cache.Get("b"); v != 20 {
+		t.Errorf("expected %v but got %v", 20, v)
+	}
+	if e := cache.MapWithMeta()["a"]; !e.ExpiresAt.Equal(time.Unix(1060, 0)) {
+		t.Errorf("expected the deadline to be kept but got %v", e.ExpiresAt)
+	}
+	if _, ok := cache.Peek("x"); ok {
+		t.Error("expected missing keys not to be inserted")
+	}
+}
+
+func Test_BatchReplaceFailures(t *testing.T) {
+	store := NewStore(uuid(), WithRejectNil())
+	cache, _ := store.NewCache("batch replace failures", time.Hour)
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+
+	applied, missing, err := cache.BatchReplace(map[string]any{"a": nil, "b": 20})
+	if !errors.Is(err, ErrNilValue) {
+		t.Errorf("expected %v but got %v", ErrNilValue, err)
+	}
+	if applied != 1 || len(missing) != 0 {
+		t.Errorf("expected 1 key applied and none missing but got %d and %v", applied, missing)
+	}
+	if v, _ := cache.Get("a"); v != 1 {
+		t.Errorf("expected the rejected key to keep %v but got %v", 1, v)
+	}
+
+	if err := store.DrainNamespace("batch replace failures"); err != nil {
+		t.Fatal(err)
+	}
+	applied, _, err = cache.BatchReplace(map[string]any{"a": 10})
+	if !errors.Is(err, ErrDraining) || applied != 0 {
+		t.Errorf("expected %v and nothing applied but got %v and %d", ErrDraining, err, applied)
+	}
+}
+
+func Test_WatchNamespaces(t *testing.T) {
+	store := NewStore(uuid())
+	events, unwatch := store.WatchNamespaces()
+
+	for _, ns := range []string{"a", "b"} {
+		if _, err := store.NewCache(ns, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	store.RemoveEmpty()
+
+	want := []NamespaceEvent{
+		{Namespace: "a", Kind: Created},
+		{Namespace: "b", Kind: Created},
+		{Namespace: "a", Kind: Removed},
+		{Namespace: "b", Kind: Removed},
+	}
+	for _, w := range want {
+		select {
+		case got := <-events:
+			if got != w {
+				t.Errorf("expected %v but got %v", w, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", w)
+		}
+	}
+
+	unwatch()
+	if _, ok := <-events; ok {
+		t.Error("expected the channel to be closed after unwatching")
+	}
+	if _, err := store.NewCache("c", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// a watcher that never reads must not block the store
+	_, stop := store.WatchNamespaces()
+	defer stop()
+	for i := 0; i < subscriberBuffer*2; i++ {
+		if _, err := store.NewCache("slow"+strconv.Itoa(i), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_GetStaleWhileRevalidate(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	cache, _ := store.NewCache("swr", time.Hour)
+
+	var calls atomic.Int32
+	loaded := make(chan struct{}, 10)
+	loader := func() (any, error) {
+		n := calls.Add(1)
+		defer func() { loaded <- struct{}{} }()
+		return "v" + strconv.Itoa(int(n)), nil
+	}
+
+	v, err := cache.GetStaleWhileRevalidate("foo", loader, time.Second, time.Minute)
+	if err != nil || v != "v1" {
+		t.Fatalf("expected %v but got %v, %v", "v1", v, err)
+	}
+	<-loaded
+
+	v, err = cache.GetStaleWhileRevalidate("foo", loader, time.Second, time.Minute)
+	if err != nil || v != "v1" {
+		t.Errorf("expected a fresh hit of %v but got %v, %v", "v1", v, err)
+	}
+
+	clock.Advance(2 * time.Second)
+	for i := 0; i < 5; i++ {
+		v, err = cache.GetStaleWhileRevalidate("foo", loader, time.Second, time.Minute)
+		if err != nil || v != "v1" {
+			t.Errorf("expected the stale value %v but got %v, %v", "v1", v, err)
+		}
+	}
+	select {
+	case <-loaded:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the background refresh")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected exactly one background load but the loader ran %d times", n)
+	}
+	if v, _ := cache.Peek("foo"); v != "v2" {
+		t.Errorf("expected the refreshed value %v but got %v", "v2", v)
+	}
+
+	clock.Advance(time.Minute)
+	v, err = cache.GetStaleWhileRevalidate("foo", loader, time.Second, time.Minute)
+	if err != nil || v != "v3" {
+		t.Errorf("expected a blocking load of %v but got %v, %v", "v3", v, err)
+	}
+}
+
+func Test_MemoryPressureThreshold(t *testing.T) {
+	store := NewStore(uuid())
+	pressured, _ := store.NewCache("pressured", time.Hour)
+	relaxed, _ := store.NewCache("relaxed", time.Hour)
+	unset, _ := store.NewCache("unset", time.Hour)
+	for _, cache := range []*Cache{pressured, relaxed, unset} {
+		for i := 0; i < 100; i++ {
+			if err := cache.Add(strconv.Itoa(i), strings.Repeat("x", 64)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pressured.SetMemoryPressureThreshold(1)
+	relaxed.SetMemoryPressureThreshold(math.MaxUint64)
+	if _, err := store.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+
+	if pressured.Size() != 0 {
+		t.Errorf("expected the pressured cache to shed every entry but it has %d", pressured.Size())
+	}
+	if relaxed.Size() != 100 {
+		t.Errorf("expected the cache below its threshold to keep %d entries but it has %d", 100, relaxed.Size())
+	}
+	if unset.Size() != 100 {
+		t.Errorf("expected the cache without a threshold to keep %d entries but it has %d", 100, unset.Size())
+	}
+}
+
+func Test_RemoveWhere(t *testing.T) {
+	store := NewStore(uuid())
+	sizes := map[string]int{"tiny": 1, "small": 5, "medium": 20, "large": 50}
+	for ns, n := range sizes {
+		cache, _ := store.NewCache(ns, time.Minute)
+		for i := 0; i < n; i++ {
+			if err := cache.Add(strconv.Itoa(i), i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	removed := store.RemoveWhere(func(namespace string, c *Cache) bool {
+		return c.Size() > 10
+	})
+	if removed != 2 {
+		t.Errorf("expected %d namespaces removed but got %d", 2, removed)
+	}
+	got := store.Namespaces()
+	sort.Strings(got)
+	if want := []string{"small", "tiny"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected survivors %v but got %v", want, got)
+	}
+
+	// pred may use the store without deadlocking
+	if n := store.RemoveWhere(func(namespace string, c *Cache) bool {
+		return !store.Has(namespace)
+	}); n != 0 {
+		t.Errorf("expected nothing removed but got %d", n)
+	}
+}
+
+func Test_WithEncryption(t *testing.T) {
+	store := NewStore(uuid())
+	key := bytes.Repeat([]byte{7}, 32)
+	cache, _ := store.NewCache("encrypted", time.Minute, WithEncryption(key))
+
+	secret := "hunter2-correct-horse"
+	if err := cache.Add("password", secret); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := cache.Get("password"); !ok || v != secret {
+		t.Errorf("expected %v but got %v", secret, v)
+	}
+
+	raw, _ := cache.storage.Load("password")
+	stored, ok := raw.(*entry).value.([]byte)
+	if !ok {
+		t.Fatalf("expected the stored form to be ciphertext bytes but got %T", raw.(*entry).value)
+	}
+	if bytes.Contains(stored, []byte(secret)) {
+		t.Error("expected the stored form not to contain the plaintext")
+	}
+
+	if err := cache.Replace("password", "rotated"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := cache.Get("password"); v != "rotated" {
+		t.Errorf("expected %v but got %v", "rotated", v)
+	}
+
+	if err := cache.Add("func", func() {}); err == nil {
+		t.Error("expected an error for a value gob cannot serialize")
+	}
+
+	bad, _ := store.NewCache("bad key", time.Minute, WithEncryption([]byte("short")))
+	if err := bad.Add("foo", "bar"); err == nil || !strings.Contains(err.Error(), "invalid encryption key") {
+		t.Errorf("expected an invalid key error but got %v", err)
+	}
+
+	other, _ := store.NewCache("other key", time.Minute, WithEncryption(bytes.Repeat([]byte{9}, 32)))
+	other.storage.Store("password", newEntry(stored, time.Time{}, time.Now(), time.Now()))
+	if _, ok := other.Get("password"); ok {
+		t.Error("expected a value encrypted under another key not to decrypt")
+	}
+}
+
+func Test_SizeByType(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("size by type", time.Minute)
+	items := map[string]any{
+		"i1": 1, "i2": 2, "i3": 3,
+		"s1": "a", "s2": "b",
+		"b1": []byte("x"),
+		"n1": nil,
+		"p1": (*Entry)(nil),
+	}
+	for k, v := range items {
+		if err := cache.Add(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]int{"int": 3, "string": 2, "[]uint8": 1, "<nil>": 1, "*cch.Entry": 1}
+	if got := cache.SizeByType(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+}
+
+func Test_NewCacheOrRenew(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+
+	first, err := store.NewCacheOrRenew("renew", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Add("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1060, 0); !first.ExpiresAt().Equal(want) {
+		t.Errorf("expected expiry %v but got %v", want, first.ExpiresAt())
+	}
+
+	clock.Advance(30 * time.Second)
+	second, err := store.NewCacheOrRenew("renew", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Error("expected the existing cache to be returned")
+	}
+	if want := time.Unix(1090, 0); !second.ExpiresAt().Equal(want) {
+		t.Errorf("expected the expiry to be extended to %v but got %v", want, second.ExpiresAt())
+	}
+	if v, _ := second.Get("foo"); v != "bar" {
+		t.Errorf("expected the entries to be kept but got %v", v)
+	}
+
+	if _, err := store.NewCache("renew", time.Minute); err == nil {
+		t.Error("expected NewCache to reject an existing namespace")
+	}
+}
+
+func Test_SnapshotCache(t *testing.T) {
+	sc := NewSnapshotCache()
+	for i := 0; i < 100; i++ {
+		if err := sc.Add(strconv.Itoa(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sc.Add("0", 0); err == nil {
+		t.Error("expected an error adding an existing key")
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := strconv.Itoa(i % 100)
+				v, ok := sc.Get(key)
+				if !ok {
+					t.Errorf("expected %s to exist", key)
+					return
+				}
+				if n := v.(int); n%100 != i%100 {
+					t.Errorf("expected a value for %s but got %d", key, n)
+					return
+				}
+			}
+		}()
+	}
+	for round := 1; round <= 20; round++ {
+		items := make(map[string]any, 10)
+		for i := 0; i < 10; i++ {
+			k := (round*7 + i) % 100
+			items[strconv.Itoa(k)] = k + round*100
+		}
+		sc.SetMany(items)
+		if err := sc.Add("extra", round); err != nil {
+			t.Error(err)
+		}
+		if err := sc.Remove("extra"); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if sc.Size() != 100 {
+		t.Errorf("expected %d entries but got %d", 100, sc.Size())
+	}
+	if _, ok := sc.Get("extra"); ok {
+		t.Error("expected the removed key to be gone")
+	}
+	if err := sc.Remove("missing"); err == nil {
+		t.Error("expected an error removing a missing key")
+	}
+}
+
+func BenchmarkConcurrentGet(b *testing.B) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	b.Run("sync.Map", func(b *testing.B) {
+		store := NewStore(uuid())
+		cache, _ := store.NewCache("bench", time.Hour)
+		for i, key := range keys {
+			cache.Add(key, i)
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				cache.Get(keys[i%len(keys)])
+				i++
+			}
+		})
+	})
+	b.Run("snapshot", func(b *testing.B) {
+		sc := NewSnapshotCache()
+		for i, key := range keys {
+			sc.Add(key, i)
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				sc.Get(keys[i%len(keys)])
+				i++
+			}
+		})
+	})
+}
+
+func Test_Warm(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	cache, _ := store.NewCache("warm", time.Hour)
+
+	keys := make([]string, 50)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	var inflight, peak atomic.Int32
+	loader := func(key string) (any, error) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return "value" + key, nil
+	}
+
+	if err := cache.Warm(keys, loader, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	meta := cache.MapWithMeta()
+	for _, key := range keys {
+		e, ok := meta[key]
+		if !ok || e.Value != "value"+key {
+			t.Errorf("expected %s to be warmed but got %v", key, e.Value)
+		}
+		if want := time.Unix(1060, 0); !e.ExpiresAt.Equal(want) {
+			t.Errorf("expected %s to expire at %v but got %v", key, want, e.ExpiresAt)
+		}
+	}
+	if p := peak.Load(); p > warmWorkers {
+		t.Errorf("expected at most %d concurrent loads but saw %d", warmWorkers, p)
+	}
+
+	errOdd := errors.New("odd key")
+	err := cache.Warm([]string{"a", "b", "c"}, func(key string) (any, error) {
+		if key != "b" {
+			return nil, errOdd
+		}
+		return key, nil
+	}, time.Minute)
+	if !errors.Is(err, errOdd) {
+		t.Errorf("expected %v but got %v", errOdd, err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if !strings.Contains(err.Error(), "warm "+key) {
+			t.Errorf("expected the error to name %s but got %v", key, err)
+		}
+		if _, ok := cache.Peek(key); ok {
+			t.Errorf("expected %s not to be cached after a loader error", key)
+		}
+	}
+	if v, ok := cache.Peek("b"); !ok || v != "b" {
+		t.Errorf("expected %v but got %v", "b", v)
+	}
+}
+
+func Test_NamespaceNormalizerTransactions(t *testing.T) {
+	store := NewStore(uuid(), WithNamespaceNormalizer(strings.ToLower))
+	cache, _ := store.NewCache("tenant", time.Minute)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Transaction(func(tx *Tx) error {
+			if err := tx.Add("Tenant", "a", 1); err != nil {
+				return err
+			}
+			return tx.Add("tenant", "b", 2)
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("transaction deadlocked on differently cased namespaces")
+	}
+	if cache.Size() != 2 {
+		t.Errorf("expected %d keys but got %d", 2, cache.Size())
+	}
+
+	if err := store.Rebalance(func(namespace, key string, value any) string {
+		return "TENANT"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Size() != 2 {
+		t.Errorf("expected keys routed to the same namespace to stay put but the cache has %d", cache.Size())
+	}
+}
+
+func Test_SwapConcurrentRemove(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("swap remove", time.Minute)
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	for round := 0; round < 50; round++ {
+		for _, key := range keys {
+			if err := cache.AddWith(key, 0, Overwrite); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cache.RemoveMany(keys)
+		}()
+		go func() {
+			defer wg.Done()
+			for _, key := range keys {
+				if _, err := cache.Swap(key, 1); err != nil && !strings.Contains(err.Error(), "key not found") {
+					t.Error(err)
+				}
+			}
+		}()
+		wg.Wait()
+		if cache.Size() != 0 {
+			t.Fatalf("expected Swap not to restore removed keys but %d remain", cache.Size())
+		}
+	}
+}
+
+func Test_RebuiltEntriesKeepWriteTime(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	cache, _ := store.NewCache("written", time.Hour)
+	if err := cache.Add("foo", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(10 * time.Minute)
+	cache.Get("foo")
+	if err := cache.ExpireAfter("foo", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clone := store.Clone(uuid())
+
+	for name, c := range map[string]*Cache{"original": cache, "clone": clone.MustUse("written")} {
+		if _, age, ok := c.aged("foo"); !ok || age != 10*time.Minute {
+			t.Errorf("expected the %s entry to be %v old but got %v", name, 10*time.Minute, age)
+		}
+	}
+
+	var calls atomic.Int32
+	v, err := cache.GetStaleWhileRevalidate("foo", func() (any, error) {
+		calls.Add(1)
+		return "new", nil
+	}, time.Minute, 5*time.Minute)
+	if err != nil || v != "new" {
+		t.Errorf("expected a reload of a value older than stale but got %v, %v", v, err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected %d load but got %d", 1, calls.Load())
+	}
+}
+
+func Test_WritesTreatExpiredKeysAsMissing(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	cache, _ := store.NewCache("expired writes", time.Hour)
+	for _, key := range []string{"add", "replace", "swap", "version", "tx"} {
+		if err := cache.AddWithTTL(key, "old", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(time.Second)
+
+	if err := cache.Add("add", "new"); err != nil {
+		t.Errorf("expected Add to take the place of an expired key but got %v", err)
+	}
+	if v, ok := cache.Get("add"); !ok || v != "new" {
+		t.Errorf("expected %v but got %v", "new", v)
+	}
+	if err := cache.Replace("replace", "new"); err == nil {
+		t.Error("expected Replace of an expired key to report it missing")
+	}
+	if _, err := cache.Swap("swap", "new"); err == nil {
+		t.Error("expected Swap of an expired key to report it missing")
+	}
+	if _, _, err := cache.GetWithVersion("version"); err == nil {
+		t.Error("expected GetWithVersion of an expired key to report it missing")
+	}
+	if _, err := cache.LastAccess("version"); err == nil {
+		t.Error("expected LastAccess of an expired key to report it missing")
+	}
+	if err := store.Transaction(func(tx *Tx) error {
+		if _, ok := tx.Get("expired writes", "tx"); ok {
+			t.Error("expected a transaction to see an expired key as missing")
+		}
+		return tx.Add("expired writes", "tx", "new")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := cache.Get("tx"); !ok || v != "new" {
+		t.Errorf("expected %v but got %v", "new", v)
+	}
+}
+
+func Test_TransformedCachesCloneAndCompare(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	store := NewStore(uuid())
+	a, _ := store.NewCache("a", time.Minute, WithEncryption(key))
+	b, _ := store.NewCache("b", time.Minute, WithEncryption(key))
+	for _, c := range []*Cache{a, b} {
+		if err := c.Add("secret", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !a.EqualValues(b) {
+		t.Error("expected encrypted caches holding the same values to compare equal")
+	}
+
+	clone := store.CloneFunc(uuid(), func(v any) any {
+		return v.(string) + "-copy"
+	})
+	if v, ok := clone.MustUse("a").Get("secret"); !ok || v != "value-copy" {
+		t.Errorf("expected the clone to decrypt %v but got %v", "value-copy", v)
+	}
+
+	m, err := a.Map()
+	if err != nil || m["secret"] != "value" {
+		t.Errorf("expected Map to decode %v but got %v, %v", "value", m["secret"], err)
+	}
+	if v, ok := store.Snapshot().Get("a", "secret"); !ok || v != "value" {
+		t.Errorf("expected the snapshot to hold %v but got %v", "value", v)
+	}
+
+	var buf bytes.Buffer
+	if err := store.Save(&buf, JSONCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Restore(&buf, JSONCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := restored.MustUse("a").Get("secret"); !ok || v != "value" {
+		t.Errorf("expected the restored store to hold %v but got %v", "value", v)
+	}
+
+	data, err := json.Marshal(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"secret":"value"`)) {
+		t.Errorf("expected MarshalJSON to export decoded values but got %s", data)
+	}
+	buf.Reset()
+	if err := store.StreamJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"value":"value"`) {
+		t.Errorf("expected StreamJSON to export decoded values but got %s", buf.String())
+	}
+}
+
+func Test_ExpirePolicyEmptiesFullCaches(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock), WithExpirePolicy(EmptyNamespace))
+	cache, _ := store.NewCache("full", time.Minute)
+	for i := 0; i < 10; i++ {
+		if err := cache.Add(strconv.Itoa(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(time.Hour)
+	n, err := store.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected %d namespace swept but got %d", 1, n)
+	}
+	if cache.Size() != 0 {
+		t.Errorf("expected the cache to be emptied but it has %d entries", cache.Size())
+	}
+	if want := clock.Now().Add(time.Minute); !cache.ExpiresAt().Equal(want) {
+		t.Errorf("expected the cache to be renewed to %v but got %v", want, cache.ExpiresAt())
+	}
+	if c, _ := store.UseNamespace("full"); c != cache {
+		t.Error("expected the same *Cache to be kept")
+	}
+}
+
+func Test_TieredStorePromotion(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	hot, _ := store.NewCache("hot", time.Hour)
+	cold, _ := store.NewCache("cold", time.Hour)
+	tiered := NewTieredStore(hot, cold, 0)
+
+	if err := cold.AddWithTTL("short", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := tiered.Get("short"); !exists {
+		t.Fatal("expected a cold hit")
+	}
+	clock.Advance(2 * time.Second)
+	if _, exists := hot.Get("short"); exists {
+		t.Error("expected the promoted entry to keep the cold entry's deadline")
+	}
+
+	if err := tiered.Set("raced", "old"); err != nil {
+		t.Fatal(err)
+	}
+	read, _ := cold.storage.Load("raced")
+	if err := tiered.Set("raced", "new"); err != nil {
+		t.Fatal(err)
+	}
+	tiered.promote("raced", "old", read.(*entry))
+	if value, exists := hot.Get("raced"); exists {
+		t.Errorf("expected a stale promotion to be undone but the hot tier holds %v", value)
+	}
+	if value, _ := tiered.Get("raced"); value != "new" {
+		t.Errorf("expected %v but got %v", "new", value)
+	}
+}
+
+func Test_RingMovesNamespaces(t *testing.T) {
+	lower := WithNamespaceNormalizer(strings.ToLower)
+	stores := []*Store{NewStore("ring 1", lower), NewStore("ring 2", lower), NewStore("ring 3", lower)}
+	ring := NewRing(stores...)
+
+	if ring.StoreFor("Users") != ring.StoreFor("users") {
+		t.Error("expected namespaces to be normalized before hashing")
+	}
+
+	namespaces := make([]string, 100)
+	for i := range namespaces {
+		namespaces[i] = fmt.Sprintf("namespace %d", i)
+		cache, err := ring.NewCache(namespaces[i], time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Add("key", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for i, namespace := range namespaces {
+			cache, err := ring.UseNamespace(namespace)
+			if err != nil {
+				t.Errorf("%s: %v", stage, err)
+				continue
+			}
+			if value, _ := cache.Get("key"); value != i {
+				t.Errorf("%s: expected %v in %s but got %v", stage, i, namespace, value)
+			}
+		}
+		total := 0
+		for _, s := range ring.stores {
+			total += s.Size()
+		}
+		if total != len(namespaces) {
+			t.Errorf("%s: expected %d namespaces across the ring but got %d", stage, len(namespaces), total)
+		}
+	}
+
+	added := NewStore("ring 4", lower)
+	ring.AddStore(added)
+	if added.Size() == 0 {
+		t.Error("expected the new store to take over some namespaces")
+	}
+	check("after add")
+
+	ring.RemoveStore("ring 1")
+	if stores[0].Size() != 0 {
+		t.Errorf("expected the removed store to be emptied but it holds %d namespaces", stores[0].Size())
+	}
+	check("after remove")
+}
+
+func Test_UnmarshalBinaryInStore(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	source, _ := store.NewCache("source", time.Hour)
+	source.Add("new", 1)
+	data, err := source.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := store.NewCache("other", time.Minute)
+	if err := other.UnmarshalBinary(data); err == nil {
+		t.Error("expected an error renaming a cache that belongs to a store")
+	}
+	if other.namespace != "other" {
+		t.Errorf("expected the namespace to stay %s but got %s", "other", other.namespace)
+	}
+
+	target, _ := store.NewCache("source copy", time.Minute)
+	target.Add("old", 0)
+	blob := cacheBlob{Namespace: "source copy", Expire: clock.Now().Add(time.Hour), Entries: map[string]any{"new": 1}}
+	data, err = GobCodec{}.Marshal(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := target.Get("old"); exists {
+		t.Error("expected the old entries to be replaced")
+	}
+	if v, _ := target.Get("new"); v != 1 {
+		t.Errorf("expected %v but got %v", 1, v)
+	}
+
+	clock.Advance(2 * time.Minute)
+	for _, item := range store.expiries.due(clock.Now()) {
+		if item.namespace == "source copy" {
+			t.Error("expected the expiry index to follow the unmarshaled deadline")
+		}
+	}
+}
+
+func Test_StaleCacheHandleExpiry(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	stale, _ := store.NewCache("reused", time.Minute)
+	if err := store.Remove("reused"); err != nil {
+		t.Fatal(err)
+	}
+
+	stale.SetExpiry(clock.Now())
+	if _, err := store.Sweep(); err != nil {
+		t.Errorf("expected a removed namespace to be skipped but got %v", err)
+	}
+
+	fresh, _ := store.NewCache("reused", time.Minute)
+	stale.SetExpiry(clock.Now().Add(time.Hour))
+	clock.Advance(2 * time.Minute)
+	n, err := store.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || store.Has("reused") {
+		t.Errorf("expected the recreated namespace to be swept but %d were and it exists: %v", n, store.Has("reused"))
+	}
+	if fresh == stale {
+		t.Error("expected a new cache for the recreated namespace")
+	}
+}
+
+func Test_RestoredCachesUseStoreDefaults(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("defaults", time.Hour)
+	cache.Add("saved", 1)
+
+	var buf bytes.Buffer
+	if err := store.Save(&buf, JSONCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Restore(&buf, JSONCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored.SetDefaultTTL(time.Minute)
+	restoredCache, err := restored.UseNamespace("defaults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoredCache.Add("added", 2); err != nil {
+		t.Fatal(err)
+	}
+	if e := restoredCache.MapWithMeta()["added"]; e.ExpiresAt.IsZero() {
+		t.Error("expected the restored store's default TTL to apply")
+	}
+	if !restoredCache.ExpiresAt().Equal(cache.ExpiresAt()) {
+		t.Errorf("expected expiry %v but got %v", cache.ExpiresAt(), restoredCache.ExpiresAt())
+	}
+}
+
+func Test_ExpirePolicyRenewsLoadedNamespaces(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock), WithExpirePolicy(EmptyNamespace))
+	loader := func() (any, error) { return 1, nil }
+	if _, err := store.Load("loaded", "key", time.Minute, loader); err != nil {
+		t.Fatal(err)
+	}
+	cache, _ := store.UseNamespace("loaded")
+
+	clock.Advance(2 * time.Minute)
+	if n, _ := store.Sweep(); n != 1 {
+		t.Errorf("expected %d namespace swept but got %d", 1, n)
+	}
+	if want := clock.Now().Add(time.Minute); !cache.ExpiresAt().Equal(want) {
+		t.Errorf("expected the namespace to be renewed to %v but got %v", want, cache.ExpiresAt())
+	}
+
+	cache.Add("kept", 2)
+	if n, _ := store.Sweep(); n != 0 {
+		t.Errorf("expected a renewed namespace not to be swept again but %d were", n)
+	}
+	if _, exists := cache.Get("kept"); !exists {
+		t.Error("expected entries added after the renewal to survive the next sweep")
+	}
+}
+
+func Test_MergeIgnoresExpiredKeys(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock))
+	for _, policy := range []ConflictPolicy{MergeSkip, MergeError} {
+		dst, _ := store.NewCache(fmt.Sprintf("dst %d", policy), time.Hour)
+		src, _ := store.NewCache(fmt.Sprintf("src %d", policy), time.Hour)
+		dst.AddWithTTL("foo", 1, time.Second)
+		clock.Advance(2 * time.Second)
+		src.Add("foo", 10)
+
+		applied, err := dst.Merge(src, policy)
+		if err != nil {
+			t.Errorf("policy %d: expected an expired key not to conflict but got %v", policy, err)
+		}
+		if applied != 1 {
+			t.Errorf("policy %d: expected %d entry applied but got %d", policy, 1, applied)
+		}
+		if v, _ := dst.Get("foo"); v != 10 {
+			t.Errorf("policy %d: expected %v but got %v", policy, 10, v)
+		}
+	}
+}
+
+func Test_RebalanceKeepsConcurrentWrites(t *testing.T) {
+	store := NewStore(uuid())
+	source, _ := store.NewCache("source", time.Minute)
+	source.Add("key", 1)
+
+	err := store.Rebalance(func(namespace, key string, value any) string {
+		if namespace == "source" {
+			// a write that lands while the entry is being moved
+			source.AddWith(key, 2, Overwrite)
+		}
+		return "target"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := source.Get("key"); v != 2 {
+		t.Errorf("expected the newer write to stay in the source but got %v", v)
+	}
+	if target, err := store.UseNamespace("target"); err == nil {
+		if v, exists := target.Get("key"); exists {
+			t.Errorf("expected the stale copy to be taken out of the target but got %v", v)
+		}
+	}
+}
+
+func Test_WatchNamespacesOrder(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		store := NewStore(uuid())
+		events, unwatch := store.WatchNamespaces()
+
+		wg := new(sync.WaitGroup)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 8; i++ {
+				store.NewCache("flapping", time.Minute)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 8; i++ {
+				store.Remove("flapping")
+			}
+		}()
+		wg.Wait()
+		unwatch()
+
+		want := Created
+		for event := range events {
+			if event.Kind != want {
+				t.Fatalf("round %d: expected creates and removes to alternate but got %v twice", round, event.Kind)
+			}
+			if want == Created {
+				want = Removed
+			} else {
+				want = Created
+			}
+		}
+	}
+}
+
+func Test_EncryptedCacheAccessorsDecode(t *testing.T) {
+	key := make([]byte, 32)
+	store := NewStore(uuid())
+	cache, err := store.NewCache("encrypted", time.Minute, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Add("greeting", "hello")
+
+	if got := cache.SizeByType(); !reflect.DeepEqual(got, map[string]int{"string": 1}) {
+		t.Errorf("expected SizeByType to see decoded values but got %v", got)
+	}
+	var buf bytes.Buffer
+	if err := cache.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "hello") {
+		t.Errorf("expected Dump to print decoded values but got %q", buf.String())
+	}
+}
+
+func Test_MarshalBinaryAcrossTransforms(t *testing.T) {
+	key := make([]byte, 16)
+	encrypted, _ := NewStore(uuid()).NewCache("secrets", time.Minute, WithEncryption(key))
+	encrypted.Add("token", "s3cret")
+
+	data, err := encrypted.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := new(Cache)
+	if err := plain.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := plain.Get("token"); v != "s3cret" {
+		t.Errorf("expected a cache without a transform to read %q but got %v", "s3cret", v)
+	}
+
+	data, err = plain.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewStore(uuid()).NewCache("secrets", time.Minute, WithEncryption(make([]byte, 32)))
+	if err := other.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := other.Get("token"); v != "s3cret" {
+		t.Errorf("expected a cache with another key to read %q but got %v", "s3cret", v)
+	}
+	if stored, _ := other.storage.Load("token"); stored.(*entry).value == "s3cret" {
+		t.Error("expected the receiving cache to encrypt the value")
+	}
+}
+
+func Test_StreamJSONOrder(t *testing.T) {
+	store := NewStore(uuid())
+	for _, namespace := range []string{"b", "a"} {
+		cache, _ := store.NewCache(namespace, time.Minute)
+		for i := 0; i < 100; i++ {
+			cache.Add(fmt.Sprintf("key %03d", (i*37)%100), i)
+		}
+	}
+
+	var first string
+	for run := 0; run < 5; run++ {
+		var buf bytes.Buffer
+		if err := store.StreamJSON(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if run == 0 {
+			first = buf.String()
+		} else if buf.String() != first {
+			t.Fatal("expected the same output on every run")
+		}
+
+		var prev string
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var rec streamRecord
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Kind == "store" {
+				continue
+			}
+			next := rec.Namespace + "\x00" + rec.Key
+			if next <= prev {
+				t.Fatalf("expected records in sorted order but %q came after %q", next, prev)
+			}
+			prev = next
+		}
+	}
+}
+
+func Test_RingFailedMoveKeepsSource(t *testing.T) {
+	if err := NewRing().AddStore(nil); err == nil {
+		t.Error("expected an error adding a nil store")
+	}
+
+	var failing atomic.Bool
+	encode := func(v any) (any, error) {
+		if failing.Load() {
+			return nil, errors.New("encode failed")
+		}
+		return v, nil
+	}
+	decode := func(v any) (any, error) { return v, nil }
+
+	stores := []*Store{NewStore("ring 1"), NewStore("ring 2"), NewStore("ring 3")}
+	ring := NewRing(stores...)
+	namespaces := make([]string, 100)
+	for i := range namespaces {
+		namespaces[i] = fmt.Sprintf("namespace %d", i)
+		cache, err := ring.StoreFor(namespaces[i]).NewCache(namespaces[i], time.Minute, WithValueTransform(encode, decode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.Add("key", i)
+	}
+
+	failing.Store(true)
+	added := NewStore("ring 4")
+	if err := ring.AddStore(added); err == nil {
+		t.Error("expected an error for namespaces that could not be moved")
+	}
+	if added.Size() != 0 {
+		t.Errorf("expected failed moves to leave nothing on the new store but it holds %d", added.Size())
+	}
+	for i, namespace := range namespaces {
+		found := false
+		for _, s := range stores {
+			if cache, err := s.UseNamespace(namespace); err == nil {
+				found = true
+				if v, _ := cache.Get("key"); v != i {
+					t.Errorf("expected %v in %s but got %v", i, namespace, v)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("expected %s to stay on its original store", namespace)
+		}
+	}
+}
+
+func Test_RemoveWhereRechecks(t *testing.T) {
+	store := NewStore(uuid())
+	cache, _ := store.NewCache("filling", time.Minute)
+
+	calls := 0
+	removed := store.RemoveWhere(func(namespace string, c *Cache) bool {
+		calls++
+		matched := c.Size() == 0
+		if calls == 1 {
+			// the namespace gains an entry after it first matched
+			c.Add("late", 1)
+		}
+		return matched
+	})
+	if removed != 0 {
+		t.Errorf("expected a namespace that stopped matching to be kept but %d were removed", removed)
+	}
+	if !store.Has("filling") || cache.Size() != 1 {
+		t.Error("expected the namespace and its entry to survive")
+	}
+}
+
+func Test_NewCacheOrRenewSetsTTL(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	store := NewStore(uuid(), WithClock(clock), WithExpirePolicy(EmptyNamespace))
+	cache, _ := store.NewCache("renewed", time.Minute)
+
+	if _, err := store.NewCacheOrRenew("renewed", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+	if n, _ := store.Sweep(); n != 1 {
+		t.Errorf("expected %d namespace swept but got %d", 1, n)
+	}
+	if want := clock.Now().Add(time.Hour); !cache.ExpiresAt().Equal(want) {
+		t.Errorf("expected the sweep to renew with the new ttl to %v but got %v", want, cache.ExpiresAt())
+	}
+}
@@ -0,0 +1,51 @@
+package cch
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time used for expiry decisions
+type Clock interface {
+	Now() time.Time
+}
+
+// wallClock is the default Clock, backed by time.Now
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock that only moves when told to. It lets tests expire
+// caches and keys without sleeping.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock creates a manual clock set to t
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{now: t}
+}
+
+// Now returns the clock's current time
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
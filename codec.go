@@ -0,0 +1,250 @@
+package cch
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Codec encodes and decodes store contents for persistence
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec encodes store contents as JSON
+type JSONCodec struct{}
+
+// Marshal encodes v as JSON
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON data into v
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes store contents with encoding/gob. Custom value types
+// must be registered with gob.Register before saving or restoring.
+type GobCodec struct{}
+
+// Marshal encodes v with gob
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes gob data into v
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type storeDump struct {
+	ID     string
+	Caches map[string]cacheDump
+}
+
+type cacheDump struct {
+	Expire    time.Time
+	Entries   map[string]any
+	Deadlines map[string]time.Time
+}
+
+// Save writes the contents of the store to w using the given codec
+func (s *Store) Save(w io.Writer, codec Codec) error {
+	if s == nil {
+		return nilStore("")
+	}
+	if codec == nil {
+		return fmt.Errorf("codec cannot be nil")
+	}
+
+	snap := s.Snapshot()
+	dump := storeDump{
+		ID:     snap.id,
+		Caches: make(map[string]cacheDump, len(snap.caches)),
+	}
+	for namespace, cache := range snap.caches {
+		cd := cacheDump{
+			Expire:    cache.expire,
+			Entries:   make(map[string]any, len(cache.entries)),
+			Deadlines: make(map[string]time.Time),
+		}
+		for k, e := range cache.entries {
+			cd.Entries[k] = e.value
+			if !e.expires.IsZero() {
+				cd.Deadlines[k] = e.expires
+			}
+		}
+		dump.Caches[namespace] = cd
+	}
+
+	data, err := codec.Marshal(dump)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Restore reads a store previously written by Save from r using the given codec
+func Restore(r io.Reader, codec Codec) (*Store, error) {
+	if codec == nil {
+		return nil, fmt.Errorf("codec cannot be nil")
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var dump storeDump
+	if err := codec.Unmarshal(data, &dump); err != nil {
+		return nil, err
+	}
+
+	store := NewStore(dump.ID)
+	for namespace, cd := range dump.Caches {
+		cache, err := store.newCacheUntil(namespace, cd.Expire)
+		if err != nil {
+			return nil, err
+		}
+		now := cache.now()
+		for k, v := range cd.Entries {
+			cache.remember(k)
+			cache.storage.Store(k, newEntry(v, cd.Deadlines[k], now, now))
+		}
+	}
+	return store, nil
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*Cache)(nil)
+	_ encoding.BinaryUnmarshaler = (*Cache)(nil)
+)
+
+type cacheBlob struct {
+	Namespace string
+	Expire    time.Time
+	Entries   map[string]any
+	Deadlines map[string]time.Time
+}
+
+// MarshalBinary encodes the cache's namespace, expiry and entries with gob.
+// Values are decoded by the cache's value transform first, so the output
+// does not depend on the transform and any cache can read it back. Custom
+// value types must be registered with gob.Register.
+func (c *Cache) MarshalBinary() ([]byte, error) {
+	if c == nil {
+		return nil, nilCache("")
+	}
+	blob := cacheBlob{
+		Namespace: c.namespace,
+		Expire:    c.expiry(),
+		Entries:   make(map[string]any),
+		Deadlines: make(map[string]time.Time),
+	}
+	var err error
+	c.storage.Range(func(key, value any) bool {
+		e := value.(*entry)
+		var decoded any
+		if decoded, err = c.load(e.value); err != nil {
+			err = fmt.Errorf("decoding %s: %w", key, err)
+			return false
+		}
+		blob.Entries[key.(string)] = decoded
+		if !e.expires.IsZero() {
+			blob.Deadlines[key.(string)] = e.expires
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GobCodec{}.Marshal(blob)
+}
+
+// UnmarshalBinary replaces the cache's namespace, expiry and entries with
+// those decoded from data produced by MarshalBinary, running values through
+// the cache's own value transform. The entries are
+// swapped in at once, so concurrent writes land in either the old or the
+// new set. A cache that belongs to a store keeps its namespace; data for a
+// different namespace is rejected.
+func (c *Cache) UnmarshalBinary(data []byte) error {
+	if c == nil {
+		return nilCache("")
+	}
+	var blob cacheBlob
+	if err := (GobCodec{}).Unmarshal(data, &blob); err != nil {
+		return err
+	}
+
+	entries := new(sync.Map)
+	now := c.now()
+	for k, v := range blob.Entries {
+		stored, err := c.encodeValue(v)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", k, err)
+		}
+		entries.Store(k, newEntry(stored, blob.Deadlines[k], now, now))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.index != nil && blob.Namespace != c.namespace {
+		return fmt.Errorf("cannot rename cache %s in a store to %s", c.namespace, blob.Namespace)
+	}
+	for k := range blob.Entries {
+		c.remember(k)
+	}
+	c.namespace = blob.Namespace
+	c.expire = blob.Expire
+	c.reindex()
+	if c.storage == nil {
+		c.storage = newEntryMap()
+	}
+	c.storage.replace(entries)
+	return nil
+}
+
+var _ json.Marshaler = (*Store)(nil)
+
+// MarshalJSON encodes the store as an object holding its id and a map of
+// each namespace to its entries. Keys are emitted in sorted order. A value
+// that cannot be encoded is reported with its namespace and key.
+func (s *Store) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		return []byte("null"), nil
+	}
+
+	snap := s.Snapshot()
+	namespaces := make(map[string]map[string]json.RawMessage, len(snap.caches))
+	for namespace, cache := range snap.caches {
+		entries := make(map[string]json.RawMessage, len(cache.entries))
+		for key, e := range cache.entries {
+			data, err := json.Marshal(e.value)
+			if err != nil {
+				return nil, fmt.Errorf("marshaling %s/%s: %w", namespace, key, err)
+			}
+			entries[key] = data
+		}
+		namespaces[namespace] = entries
+	}
+
+	return json.Marshal(struct {
+		ID         string                                `json:"id"`
+		Namespaces map[string]map[string]json.RawMessage `json:"namespaces"`
+	}{
+		ID:         snap.id,
+		Namespaces: namespaces,
+	})
+}
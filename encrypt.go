@@ -0,0 +1,74 @@
+package cch
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// ErrCiphertext is returned when a stored value cannot be decrypted
+var ErrCiphertext = errors.New("value cannot be decrypted")
+
+// sealed is the gob envelope for an encrypted value, so that any
+// registered type round-trips through the interface
+type sealed struct {
+	Value any
+}
+
+// WithEncryption keeps values encrypted in memory with AES-GCM so a heap
+// dump does not expose them. key must be 16, 24 or 32 bytes to select
+// AES-128, AES-192 or AES-256; with any other length every write and read
+// fails with an invalid key error. Values are serialized with gob before
+// encryption, so custom types must be registered with gob.Register and
+// values gob cannot encode are rejected. It is built on WithValueTransform
+// and replaces any transform set before it.
+func WithEncryption(key []byte) CacheOption {
+	aead, err := newGCM(key)
+	encode := func(value any) (any, error) {
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(sealed{Value: value}); err != nil {
+			return nil, fmt.Errorf("value cannot be serialized for encryption: %w", err)
+		}
+		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+buf.Len()+aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return aead.Seal(nonce, nonce, buf.Bytes(), nil), nil
+	}
+	decode := func(stored any) (any, error) {
+		if err != nil {
+			return nil, err
+		}
+		data, ok := stored.([]byte)
+		if !ok || len(data) < aead.NonceSize() {
+			return nil, ErrCiphertext
+		}
+		nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCiphertext, err)
+		}
+		var s sealed
+		if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&s); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCiphertext, err)
+		}
+		return s.Value, nil
+	}
+	return WithValueTransform(encode, decode)
+}
+
+// newGCM returns an AES-GCM cipher for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,102 @@
+package cch
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// entryMap is a sync.Map of key to *entry whose backing map can be
+// replaced by compact. Reads go straight to the current map; each write
+// holds a read lock so that none can land in a map that compact has
+// already copied and is about to discard.
+type entryMap struct {
+	mu sync.RWMutex
+	m  atomic.Pointer[sync.Map]
+}
+
+func newEntryMap() *entryMap {
+	em := new(entryMap)
+	em.m.Store(new(sync.Map))
+	return em
+}
+
+func (em *entryMap) Load(key any) (any, bool) {
+	return em.m.Load().Load(key)
+}
+
+func (em *entryMap) Range(fn func(key, value any) bool) {
+	em.m.Load().Range(fn)
+}
+
+func (em *entryMap) Store(key, value any) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	em.m.Load().Store(key, value)
+}
+
+func (em *entryMap) LoadOrStore(key, value any) (any, bool) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	return em.m.Load().LoadOrStore(key, value)
+}
+
+func (em *entryMap) CompareAndSwap(key, old, new any) bool {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	return em.m.Load().CompareAndSwap(key, old, new)
+}
+
+func (em *entryMap) Delete(key any) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	em.m.Load().Delete(key)
+}
+
+func (em *entryMap) LoadAndDelete(key any) (any, bool) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	return em.m.Load().LoadAndDelete(key)
+}
+
+func (em *entryMap) CompareAndDelete(key, old any) bool {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	return em.m.Load().CompareAndDelete(key, old)
+}
+
+// compact copies the entries for which keep returns true into a fresh map
+// and replaces the current one with it, releasing the old map's backing
+// storage. Writes wait until the copy is in place. Entries are copied by
+// pointer, so compare-and-swap loops that loaded an entry before the copy
+// still succeed after it.
+func (em *entryMap) compact(keep func(e *entry) bool) int {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+
+	fresh := new(sync.Map)
+	n := 0
+	em.m.Load().Range(func(key, value any) bool {
+		if keep(value.(*entry)) {
+			fresh.Store(key, value)
+			n++
+		}
+		return true
+	})
+	em.m.Store(fresh)
+	return n
+}
+
+// clear replaces the current map with an empty one and returns the old
+// map. Writes wait until the swap is done, so each lands either in the
+// returned map or in the new one.
+func (em *entryMap) clear() *sync.Map {
+	return em.replace(new(sync.Map))
+}
+
+// replace swaps m in as the current map and returns the old one, with the
+// same guarantee for concurrent writes as clear
+func (em *entryMap) replace(m *sync.Map) *sync.Map {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	return em.m.Swap(m)
+}
@@ -0,0 +1,61 @@
+package cch
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is a single operation recorded in a cache's event log
+type Event struct {
+	Op   string
+	Key  string
+	Time time.Time
+}
+
+// eventLog is a fixed-size ring buffer of the most recent events
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+// WithEventLog keeps the last max operations (get, add, remove and replace)
+// performed on the cache, retrievable with History
+func WithEventLog(max int) CacheOption {
+	return func(c *Cache) {
+		if max > 0 {
+			c.events = &eventLog{events: make([]Event, max)}
+		}
+	}
+}
+
+func (l *eventLog) record(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+func (l *eventLog) history() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Event(nil), l.events[:l.next]...)
+	}
+	history := make([]Event, 0, len(l.events))
+	history = append(history, l.events[l.next:]...)
+	return append(history, l.events[:l.next]...)
+}
+
+// History returns the operations retained by the cache's event log, oldest
+// first. It returns nil if the cache was created without WithEventLog.
+func (c *Cache) History() []Event {
+	if c == nil || c.events == nil {
+		return nil
+	}
+	return c.events.history()
+}
@@ -0,0 +1,91 @@
+package cch
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryIndex is a min-heap of cache deadlines, letting a sweep visit only
+// the namespaces that are due instead of scanning the whole store. Items
+// are keyed by *Cache rather than by namespace, so a handle to a removed
+// cache cannot move the deadline of a namespace recreated under its name.
+type expiryIndex struct {
+	mu    sync.Mutex
+	items expiryHeap
+	pos   map[*Cache]*expiryItem
+}
+
+type expiryItem struct {
+	namespace string
+	cache     *Cache
+	at        time.Time
+	index     int
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{pos: make(map[*Cache]*expiryItem)}
+}
+
+// set records the deadline of cache at namespace, replacing any previous one
+func (x *expiryIndex) set(namespace string, cache *Cache, at time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if item, exists := x.pos[cache]; exists {
+		item.at = at
+		heap.Fix(&x.items, item.index)
+		return
+	}
+	item := &expiryItem{namespace: namespace, cache: cache, at: at}
+	x.pos[cache] = item
+	heap.Push(&x.items, item)
+}
+
+// remove forgets cache
+func (x *expiryIndex) remove(cache *Cache) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if item, exists := x.pos[cache]; exists {
+		heap.Remove(&x.items, item.index)
+		delete(x.pos, cache)
+	}
+}
+
+// due removes and returns every item whose deadline is not after now
+func (x *expiryIndex) due(now time.Time) []*expiryItem {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var items []*expiryItem
+	for len(x.items) > 0 && !x.items[0].at.After(now) {
+		item := heap.Pop(&x.items).(*expiryItem)
+		delete(x.pos, item.cache)
+		items = append(items, item)
+	}
+	return items
+}
+
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
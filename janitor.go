@@ -0,0 +1,75 @@
+package cch
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// RunJanitor sweeps expired caches from the store every interval until ctx
+// is canceled or the store is closed, then returns nil. It blocks, so it is
+// typically run in its own goroutine or under an errgroup. Sweep failures
+// are reported through the store's logger. An interval that is not
+// positive is rejected with an error.
+func (s *Store) RunJanitor(ctx context.Context, interval time.Duration) error {
+	if s == nil {
+		return nilStore("")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("janitor interval must be positive: %s", interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		case <-ticker.C:
+			s.Sweep()
+		}
+	}
+}
+
+// NewStoreWithContext creates a store that is closed when ctx is done,
+// stopping any janitors running on it
+func NewStoreWithContext(ctx context.Context, id string, opts ...Option) *Store {
+	s := NewStore(id, opts...)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+// Close stops every janitor running on the store. It is safe to call more
+// than once.
+func (s *Store) Close() {
+	if s == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		close(s.done)
+		logAt(s.logger, slog.LevelDebug, "store closed", "store", s.id)
+	})
+}
+
+// Closed reports whether Close has been called
+func (s *Store) Closed() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
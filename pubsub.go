@@ -0,0 +1,159 @@
+package cch
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// subscriberBuffer is the number of unread values a subscription holds
+// before further values are dropped
+const subscriberBuffer = 16
+
+// subscribers tracks the channels subscribed to each key
+type subscribers struct {
+	mu   sync.Mutex
+	subs map[string]map[chan any]struct{}
+}
+
+// Subscribe returns a channel that receives the new value each time key is
+// written by Add, AddWith, Replace or Swap, along with a function that
+// unsubscribes and closes the channel. The channel buffers up to 16 values;
+// writes made while the buffer is full are dropped for that subscriber so
+// slow readers never block the cache.
+func (c *Cache) Subscribe(key string) (<-chan any, func()) {
+	ch := make(chan any, subscriberBuffer)
+
+	c.subs.mu.Lock()
+	if c.subs.subs == nil {
+		c.subs.subs = make(map[string]map[chan any]struct{})
+	}
+	if c.subs.subs[key] == nil {
+		c.subs.subs[key] = make(map[chan any]struct{})
+	}
+	c.subs.subs[key][ch] = struct{}{}
+	c.subs.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			c.subs.mu.Lock()
+			defer c.subs.mu.Unlock()
+			delete(c.subs.subs[key], ch)
+			if len(c.subs.subs[key]) == 0 {
+				delete(c.subs.subs, key)
+			}
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// publish delivers the stored value to every subscriber of key, decoded,
+// without blocking
+func (c *Cache) publish(key string, stored any) {
+	c.subs.mu.Lock()
+	defer c.subs.mu.Unlock()
+	if len(c.subs.subs[key]) == 0 {
+		return
+	}
+	value, err := c.load(stored)
+	if err != nil {
+		logAt(c.logger, slog.LevelError, "decode failed", "namespace", c.namespace, "key", key, "error", err)
+		return
+	}
+	for ch := range c.subs.subs[key] {
+		select {
+		case ch <- value:
+		default:
+		}
+	}
+}
+
+// Wait returns the value for key, blocking until the key is written or ctx
+// is canceled if it does not exist yet
+func (c *Cache) Wait(ctx context.Context, key string) (any, error) {
+	if c == nil {
+		return nil, nilCache("")
+	}
+	if value, exists := c.Get(key); exists {
+		return value, nil
+	}
+
+	ch, unsubscribe := c.Subscribe(key)
+	defer unsubscribe()
+
+	// the key may have been written before the subscription was registered
+	if value, exists := c.Get(key); exists {
+		return value, nil
+	}
+
+	select {
+	case value := <-ch:
+		return value, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NamespaceEventKind says what happened to a namespace
+type NamespaceEventKind int
+
+const (
+	// Created means a cache was created in the namespace
+	Created NamespaceEventKind = iota
+	// Removed means the namespace was removed from the store
+	Removed
+)
+
+// NamespaceEvent is a change to the set of namespaces in a store
+type NamespaceEvent struct {
+	Namespace string
+	Kind      NamespaceEventKind
+}
+
+// namespaceWatchers tracks the channels watching a store's namespaces
+type namespaceWatchers struct {
+	mu       sync.Mutex
+	watchers map[chan NamespaceEvent]struct{}
+}
+
+// WatchNamespaces returns a channel that receives an event each time a
+// namespace is created or removed, along with a function that stops
+// watching and closes the channel. Events are published while the store
+// lock is held, so they are delivered in the order they happen. The
+// channel buffers up to 16 events; events raised while the buffer is full
+// are dropped for that watcher so slow readers never block the store.
+func (s *Store) WatchNamespaces() (<-chan NamespaceEvent, func()) {
+	ch := make(chan NamespaceEvent, subscriberBuffer)
+
+	s.watchers.mu.Lock()
+	if s.watchers.watchers == nil {
+		s.watchers.watchers = make(map[chan NamespaceEvent]struct{})
+	}
+	s.watchers.watchers[ch] = struct{}{}
+	s.watchers.mu.Unlock()
+
+	var once sync.Once
+	unwatch := func() {
+		once.Do(func() {
+			s.watchers.mu.Lock()
+			defer s.watchers.mu.Unlock()
+			delete(s.watchers.watchers, ch)
+			close(ch)
+		})
+	}
+	return ch, unwatch
+}
+
+// publish delivers event to every watcher without blocking
+func (w *namespaceWatchers) publish(event NamespaceEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.watchers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package cch
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ringReplicas is the number of points each store owns on the ring
+const ringReplicas = 100
+
+// Ring routes namespaces across several stores with consistent hashing.
+// Adding or removing a store only moves the namespaces adjacent to its
+// points on the ring. Namespaces are hashed after the namespace normalizer
+// of the first store added, so the stores on a ring should share one.
+type Ring struct {
+	mu         sync.RWMutex
+	hashes     []uint32
+	owners     map[uint32]*Store
+	stores     map[string]*Store
+	normalizer func(string) string
+}
+
+// NewRing creates a ring over the given stores. Nil stores are skipped.
+func NewRing(stores ...*Store) *Ring {
+	r := &Ring{
+		owners: make(map[uint32]*Store),
+		stores: make(map[string]*Store),
+	}
+	for _, s := range stores {
+		if s != nil {
+			r.AddStore(s)
+		}
+	}
+	return r
+}
+
+// AddStore adds a store to the ring, keyed by its id. Namespaces on other
+// stores that the new store now owns are moved to it; a namespace that
+// cannot be moved stays where it is and its error is joined into the
+// returned error.
+func (r *Ring) AddStore(s *Store) error {
+	if s == nil {
+		return nilStore("")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.stores[s.id]; exists {
+		return nil
+	}
+	r.stores[s.id] = s
+	if r.normalizer == nil {
+		r.normalizer = s.normalizer
+	}
+	for i := 0; i < ringReplicas; i++ {
+		h := ringHash(fmt.Sprintf("%s#%d", s.id, i))
+		r.owners[h] = s
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+
+	var errs []error
+	for _, from := range r.stores {
+		if from == s {
+			continue
+		}
+		for _, namespace := range from.Namespaces() {
+			if r.owner(namespace) != s {
+				continue
+			}
+			if err := moveNamespace(from, s, namespace); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RemoveStore removes the store with the given id from the ring and moves
+// its namespaces to their new owners. A namespace that cannot be moved
+// stays on the removed store and its error is joined into the returned
+// error. Removing the last store leaves its namespaces in place.
+func (r *Ring) RemoveStore(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed, exists := r.stores[id]
+	if !exists {
+		return nil
+	}
+	delete(r.stores, id)
+
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.owners[h].id == id {
+			delete(r.owners, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, namespace := range removed.Namespaces() {
+		if err := moveNamespace(removed, r.owner(namespace), namespace); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StoreFor returns the store that owns the given namespace, or nil if the
+// ring is empty
+func (r *Ring) StoreFor(namespace string) *Store {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.owner(namespace)
+}
+
+// owner returns the store that owns namespace. The caller must hold r.mu.
+func (r *Ring) owner(namespace string) *Store {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	if r.normalizer != nil {
+		namespace = r.normalizer(namespace)
+	}
+	h := ringHash(namespace)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// NewCache creates a new cache in the given namespace on its owning store
+func (r *Ring) NewCache(namespace string, expire time.Duration) (*Cache, error) {
+	return r.StoreFor(namespace).NewCache(namespace, expire)
+}
+
+// UseNamespace returns a cache within the given namespace from its owning store
+func (r *Ring) UseNamespace(namespace string) (*Cache, error) {
+	return r.StoreFor(namespace).UseNamespace(namespace)
+}
+
+// moveNamespace moves namespace from one store to another, copying its
+// entries, deadline and labels into a cache created on to with the same
+// options and then removing it from from. If anything fails, including a
+// cache already existing in namespace on to, the new cache is discarded
+// and the namespace stays on from. A *Cache obtained before the move keeps
+// pointing at the removed cache.
+func moveNamespace(from, to *Store, namespace string) error {
+	cache, err := from.UseNamespace(namespace)
+	if err != nil {
+		return nil
+	}
+	dest, err := to.NewCache(namespace, cache.ttl, cache.opts...)
+	if err != nil {
+		return fmt.Errorf("moving %s from %s to %s: %w", namespace, from.id, to.id, err)
+	}
+	dest.SetExpiry(cache.expiry())
+	cache.mu.RLock()
+	labels := cache.labels
+	cache.mu.RUnlock()
+	dest.mu.Lock()
+	dest.labels = labels
+	dest.mu.Unlock()
+
+	now := cache.now()
+	cache.storage.Range(func(key, value any) bool {
+		e := value.(*entry)
+		if e.expired(now) {
+			return true
+		}
+		var stored any
+		stored, err = cache.load(e.value)
+		if err == nil {
+			stored, err = dest.encodeValue(stored)
+		}
+		if err != nil {
+			err = fmt.Errorf("moving %s/%s from %s to %s: %w", namespace, key, from.id, to.id, err)
+			return false
+		}
+		dest.remember(key.(string))
+		dest.storage.Store(key, newEntry(stored, e.expires, e.written, e.accessed()))
+		return true
+	})
+	if err != nil {
+		to.removeCache(namespace, dest)
+		return err
+	}
+	from.removeCache(namespace, cache)
+	return nil
+}
+
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,44 @@
+package cch
+
+import "sync"
+
+// flightGroup runs at most one call per key at a time. Callers that ask
+// for a key while a call for it is in flight wait for and share its
+// result. The zero value is ready to use.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg    sync.WaitGroup
+	value any
+	err   error
+}
+
+// do calls fn for key unless a call for key is already in flight, in which
+// case it waits for that call and returns its result
+func (g *flightGroup) do(key string, fn func() (any, error)) (any, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, exists := g.calls[key]; exists {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := new(flightCall)
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err
+}
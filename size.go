@@ -0,0 +1,56 @@
+package cch
+
+import "reflect"
+
+// approxBytes estimates the memory held by value. It counts string and
+// byte slice lengths, the fixed size of scalars, and walks slices, maps,
+// structs and pointers. It is a rough figure suited to limits, not an
+// exact accounting.
+func approxBytes(value any) int64 {
+	if value == nil {
+		return 0
+	}
+	return sizeOf(reflect.ValueOf(value), make(map[uintptr]bool))
+}
+
+func sizeOf(v reflect.Value, seen map[uintptr]bool) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return int64(v.Len())
+		}
+		var n int64
+		for i := 0; i < v.Len(); i++ {
+			n += sizeOf(v.Index(i), seen)
+		}
+		return n
+	case reflect.Map:
+		var n int64
+		iter := v.MapRange()
+		for iter.Next() {
+			n += sizeOf(iter.Key(), seen) + sizeOf(iter.Value(), seen)
+		}
+		return n
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			n += sizeOf(v.Field(i), seen)
+		}
+		return n
+	case reflect.Pointer:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		return sizeOf(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return sizeOf(v.Elem(), seen)
+	default:
+		return int64(v.Type().Size())
+	}
+}
@@ -0,0 +1,116 @@
+package cch
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// StoreSnapshot is a read-only, point-in-time copy of a Store. Values are
+// copied by reference.
+type StoreSnapshot struct {
+	id     string
+	caches map[string]cacheSnapshot
+}
+
+type cacheSnapshot struct {
+	expire  time.Time
+	entries map[string]*entry
+}
+
+// Snapshot returns a copy of every namespace and entry in the store that is
+// unaffected by later mutations. Values are decoded by their cache's value
+// transform; a value that fails to decode is logged and left out.
+func (s *Store) Snapshot() StoreSnapshot {
+	if s == nil {
+		return StoreSnapshot{}
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	snap := StoreSnapshot{
+		id:     s.id,
+		caches: make(map[string]cacheSnapshot, len(s.data)),
+	}
+	for namespace, cache := range s.data {
+		entries := make(map[string]*entry)
+		cache.storage.Range(func(key, value any) bool {
+			e := value.(*entry)
+			decoded, err := cache.load(e.value)
+			if err != nil {
+				logAt(s.logger, slog.LevelError, "snapshot failed", "store", s.id, "namespace", namespace, "key", key, "error", err)
+				return true
+			}
+			entries[key.(string)] = newEntry(decoded, e.expires, e.written, e.accessed())
+			return true
+		})
+		snap.caches[namespace] = cacheSnapshot{
+			expire:  cache.expiry(),
+			entries: entries,
+		}
+	}
+	return snap
+}
+
+// Namespaces returns the sorted namespaces in the snapshot
+func (ss StoreSnapshot) Namespaces() []string {
+	var namespaces []string
+	for k := range ss.caches {
+		namespaces = append(namespaces, k)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Get gets an item from the snapshot by namespace and key
+func (ss StoreSnapshot) Get(namespace, key string) (any, bool) {
+	cache, exists := ss.caches[namespace]
+	if !exists {
+		return nil, false
+	}
+	e, exists := cache.entries[key]
+	if !exists {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Size returns the number of namespaces in the snapshot
+func (ss StoreSnapshot) Size() int {
+	return len(ss.caches)
+}
+
+// RestoreSnapshot recreates the snapshot's namespaces and entries in the
+// store with their original expiry times. Namespaces and entries whose
+// deadline has already passed are skipped. Existing namespaces are updated
+// in place and existing keys are overwritten.
+func (s *Store) RestoreSnapshot(snap StoreSnapshot) error {
+	if s == nil {
+		return nilStore("")
+	}
+
+	now := s.clock.Now()
+	for namespace, cs := range snap.caches {
+		if !cs.expire.After(now) {
+			continue
+		}
+		cache, err := s.useOrCreate(namespace, cs.expire)
+		if err != nil {
+			return err
+		}
+		cache.SetExpiry(cs.expire)
+		for key, e := range cs.entries {
+			if e.expired(now) {
+				continue
+			}
+			stored, err := cache.encodeValue(e.value)
+			if err != nil {
+				return err
+			}
+			cache.remember(key)
+			cache.storage.Store(key, newEntry(stored, e.expires, e.written, e.accessed()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package cch
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// SnapshotCache is a cache for mostly static data whose reads never take a
+// lock. The entries live in an immutable map behind an atomic pointer, so
+// Get is a single pointer load and a map lookup. Every write copies the
+// whole map and swaps the copy in, which makes writes O(n); batch them
+// with SetMany where possible. Entries do not expire.
+type SnapshotCache struct {
+	mu sync.Mutex // serializes writers
+	m  atomic.Pointer[map[string]any]
+}
+
+// NewSnapshotCache creates an empty snapshot cache
+func NewSnapshotCache() *SnapshotCache {
+	sc := new(SnapshotCache)
+	sc.m.Store(&map[string]any{})
+	return sc
+}
+
+// Get gets an item from the cache by key without locking
+func (sc *SnapshotCache) Get(key string) (any, bool) {
+	value, exists := (*sc.m.Load())[key]
+	return value, exists
+}
+
+// Size returns the number of entries in the cache
+func (sc *SnapshotCache) Size() int {
+	return len(*sc.m.Load())
+}
+
+// Add adds a new item to the cache, returning an error if the key already
+// exists
+func (sc *SnapshotCache) Add(key string, value any) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	current := *sc.m.Load()
+	if _, exists := current[key]; exists {
+		return fmt.Errorf("key already exists: %s", key)
+	}
+	next := sc.copy(current, 1)
+	next[key] = value
+	sc.m.Store(&next)
+	return nil
+}
+
+// SetMany stores every item, overwriting existing keys, with a single copy
+// of the map
+func (sc *SnapshotCache) SetMany(items map[string]any) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	next := sc.copy(*sc.m.Load(), len(items))
+	for key, value := range items {
+		next[key] = value
+	}
+	sc.m.Store(&next)
+}
+
+// Remove removes an item from the cache
+func (sc *SnapshotCache) Remove(key string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	current := *sc.m.Load()
+	if _, exists := current[key]; !exists {
+		return fmt.Errorf("key does not exist: %s", key)
+	}
+	next := sc.copy(current, 0)
+	delete(next, key)
+	sc.m.Store(&next)
+	return nil
+}
+
+// copy returns a mutable copy of m with room for extra more entries
+func (sc *SnapshotCache) copy(m map[string]any, extra int) map[string]any {
+	next := make(map[string]any, len(m)+extra)
+	for key, value := range m {
+		next[key] = value
+	}
+	return next
+}
@@ -1,59 +1,389 @@
 package cch
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"log/slog"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Store struct {
-	sync.Mutex
+	sync.RWMutex
 	id     string
 	data   map[string]*Cache
 	expire time.Time
+	logger *slog.Logger
+	clock  Clock
+
+	expiries   *expiryIndex
+	defaultTTL atomic.Int64
+	done       chan struct{}
+	closeOnce  sync.Once
+	creates    flightGroup
+	loads      flightGroup
+
+	writeRate     float64
+	maxValueBytes int64
+	stats         bool
+	expirePolicy  ExpirePolicy
+	rejectNil     bool
+	normalizer    func(namespace string) string
+	lifetime      time.Duration
+
+	onCreate []func(namespace string)
+	onRemove []func(namespace string)
+	watchers namespaceWatchers
+}
+
+// ExpirePolicy controls what a sweep does with an expired namespace
+type ExpirePolicy int
+
+const (
+	// DeleteNamespace removes the expired namespace from the store
+	DeleteNamespace ExpirePolicy = iota
+	// EmptyNamespace keeps the namespace and its *Cache, purging its
+	// entries and restarting its TTL
+	EmptyNamespace
+)
+
+// Option configures a Store
+type Option func(*Store)
+
+// WithLogger sets a structured logger for store and cache operations.
+// Nothing is logged when no logger is set.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// WithWriteRate limits how many new keys each namespace accepts per second.
+// Writes beyond the limit return ErrRateLimited until the namespace's
+// token bucket refills.
+func WithWriteRate(perSecond float64) Option {
+	return func(s *Store) {
+		s.writeRate = perSecond
+	}
+}
+
+// WithMaxValueBytes rejects values whose estimated size exceeds n bytes
+// with ErrValueTooLarge
+func WithMaxValueBytes(n int64) Option {
+	return func(s *Store) {
+		s.maxValueBytes = n
+	}
+}
+
+// WithClock sets the clock used for every expiry decision in the store and
+// its caches. Defaults to the wall clock.
+func WithClock(clock Clock) Option {
+	return func(s *Store) {
+		s.clock = clock
+	}
+}
+
+// WithStats enables hit and miss counting on every cache in the store. By
+// default Get does no counter work and Stats reports zeroes.
+func WithStats() Option {
+	return func(s *Store) {
+		s.stats = true
+	}
+}
+
+// WithExpirePolicy sets what a sweep does with expired namespaces. The
+// default, DeleteNamespace, removes them; EmptyNamespace keeps existing
+// *Cache references valid by purging and renewing the cache instead.
+func WithExpirePolicy(policy ExpirePolicy) Option {
+	return func(s *Store) {
+		s.expirePolicy = policy
+	}
+}
+
+// WithRejectNil makes writes of a nil interface or nil pointer fail with
+// ErrNilValue, so a key that is present never holds a value that reads
+// like an absent one
+func WithRejectNil() Option {
+	return func(s *Store) {
+		s.rejectNil = true
+	}
+}
+
+// WithNamespaceNormalizer runs every namespace through fn before it is
+// created or looked up, so names fn maps to the same string share a cache;
+// strings.ToLower makes namespaces case-insensitive. fn should be
+// idempotent.
+func WithNamespaceNormalizer(fn func(namespace string) string) Option {
+	return func(s *Store) {
+		s.normalizer = fn
+	}
+}
+
+// WithLifetime sets how long a new store lives before Expired reports
+// true. Defaults to 30 seconds. Nothing removes an expired store on its own;
+// the lifetime is for whatever owns the store to act on.
+func WithLifetime(d time.Duration) Option {
+	return func(s *Store) {
+		s.lifetime = d
+	}
 }
 
 // NewStore creates a new namespace cache store
-func NewStore(id string) *Store {
-	return &Store{
-		id:     id,
-		data:   make(map[string]*Cache),
-		expire: time.Now().Add(time.Second * 30),
+func NewStore(id string, opts ...Option) *Store {
+	s := &Store{
+		id:       id,
+		data:     make(map[string]*Cache),
+		clock:    wallClock{},
+		expiries: newExpiryIndex(),
+		done:     make(chan struct{}),
+		lifetime: time.Second * 30,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.expire = s.clock.Now().Add(s.lifetime)
+	return s
+}
+
+// Clone returns a copy of the store with a new id. Namespaces, entries and
+// expiry times are copied so the clone can be mutated independently, but
+// values themselves are shared by reference; use CloneFunc to copy them.
+func (s *Store) Clone(newID string) *Store {
+	return s.CloneFunc(newID, nil)
+}
+
+// CloneFunc is like Clone but passes every value through copyValue, which
+// can return a deep copy. Each cache is cloned with the options it was
+// created with, and copyValue sees values decoded by its value transform.
+func (s *Store) CloneFunc(newID string, copyValue func(value any) any) *Store {
+	if s == nil {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	clone := NewStore(newID,
+		WithLogger(s.logger),
+		WithClock(s.clock),
+		WithWriteRate(s.writeRate),
+		WithMaxValueBytes(s.maxValueBytes),
+		WithExpirePolicy(s.expirePolicy),
+		WithNamespaceNormalizer(s.normalizer),
+	)
+	clone.stats = s.stats
+	clone.rejectNil = s.rejectNil
+	clone.defaultTTL.Store(s.defaultTTL.Load())
+	clone.expire = s.expire
+
+	for namespace, cache := range s.data {
+		c, err := clone.NewCache(namespace, 0, cache.opts...)
+		if err != nil {
+			continue
+		}
+		c.SetExpiry(cache.expiry())
+		c.ttl = cache.ttl
+		cache.mu.RLock()
+		c.labels = cache.labels
+		cache.mu.RUnlock()
+		cache.storage.Range(func(key, value any) bool {
+			e := value.(*entry)
+			v := e.value
+			if copyValue != nil {
+				decoded, err := cache.load(v)
+				if err == nil {
+					v, err = c.encodeValue(copyValue(decoded))
+				}
+				if err != nil {
+					logAt(s.logger, slog.LevelError, "clone failed", "store", s.id, "namespace", namespace, "key", key, "error", err)
+					return true
+				}
+			}
+			c.remember(key.(string))
+			c.storage.Store(key, newEntry(v, e.expires, e.written, e.accessed()))
+			return true
+		})
+	}
+	return clone
+}
+
+// NewStoreFromMap creates a new store with a namespace for each outer key of
+// data, seeded with the inner entries
+func NewStoreFromMap(id string, data map[string]map[string]any, ttl time.Duration) (*Store, error) {
+	if ttl < 0 {
+		return nil, fmt.Errorf("ttl cannot be negative: %s", ttl)
+	}
+
+	s := NewStore(id)
+	for namespace, entries := range data {
+		cache, err := s.NewCache(namespace, ttl)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range entries {
+			if err := cache.Add(k, v); err != nil {
+				return nil, err
+			}
+		}
 	}
+	return s, nil
 }
 
 // NewCache creates a new cachen in the given namespace
-func (s *Store) NewCache(namespace string, expire time.Duration) (*Cache, error) {
+func (s *Store) NewCache(namespace string, expire time.Duration, opts ...CacheOption) (*Cache, error) {
 	if s == nil {
 		return nil, nilStore(namespace)
 	}
+	namespace = s.normalize(namespace)
 	s.Lock()
-	defer s.Unlock()
-
-	if cache, exists := s.data[namespace]; !exists && cache != nil {
+	if cache, exists := s.data[namespace]; exists {
+		s.Unlock()
 		return cache, fmt.Errorf("cache %s already exists", namespace)
 	}
 
 	cache := &Cache{
 		namespace: namespace,
-		storage:   new(sync.Map),
-		expire:    time.Now().Add(expire),
+		storage:   newEntryMap(),
+		expire:    s.clock.Now().Add(expire),
+		ttl:       expire,
+		index:     s.expiries,
+		logger:    s.logger,
+		clock:     s.clock,
+
+		defaultTTL:    &s.defaultTTL,
+		maxValueBytes: s.maxValueBytes,
+		rejectNil:     s.rejectNil,
+	}
+	if s.writeRate > 0 {
+		cache.limiter = newTokenBucket(s.writeRate)
+	}
+	if s.stats {
+		cache.stats = new(cacheStats)
 	}
+	for _, opt := range opts {
+		opt(cache)
+	}
+	cache.opts = opts
 	s.data[namespace] = cache
+	s.expiries.set(namespace, cache, cache.expire)
+	// published under the store lock so watchers see creates and removes
+	// of a namespace in the order they happened
+	s.watchers.publish(NamespaceEvent{Namespace: namespace, Kind: Created})
+	hooks := s.onCreate
+	s.Unlock()
+
+	logAt(s.logger, slog.LevelDebug, "cache created", "store", s.id, "namespace", namespace, "ttl", expire)
+	notify(hooks, namespace)
+
+	return cache, nil
+}
+
+// Expired reports whether the store's own deadline has passed, so that a
+// supervisor holding many stores can drop whole ones. It says nothing about
+// the namespaces inside the store, which expire independently.
+func (s *Store) Expired() bool {
+	if s == nil {
+		return true
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return !s.expire.After(s.clock.Now())
+}
+
+// Renew extends the store's deadline to d from now
+func (s *Store) Renew(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.expire = s.clock.Now().Add(d)
+}
+
+// NewCacheOrRenew returns the cache for namespace with its expiry renewed
+// to ttl from now, creating the cache with that TTL if it does not exist.
+// An existing cache takes ttl as its TTL for later renewals as well.
+func (s *Store) NewCacheOrRenew(namespace string, ttl time.Duration) (*Cache, error) {
+	if s == nil {
+		return nil, nilStore(namespace)
+	}
+	namespace = s.normalize(namespace)
 
+	s.RLock()
+	cache, exists := s.data[namespace]
+	s.RUnlock()
+	if !exists {
+		var err error
+		cache, err = s.NewCache(namespace, ttl)
+		if err == nil {
+			return cache, nil
+		}
+		if cache == nil {
+			return nil, err
+		}
+		// created concurrently; renew that one instead
+	}
+	cache.renewFor(ttl)
+	logAt(s.logger, slog.LevelDebug, "cache renewed", "store", s.id, "namespace", namespace, "ttl", ttl)
 	return cache, nil
 }
 
+// SetDefaultTTL sets how long keys added without an explicit TTL live,
+// across every namespace in the store. It affects keys written afterwards;
+// existing keys keep their deadlines. A d of zero, the default, means such
+// keys live as long as their cache.
+func (s *Store) SetDefaultTTL(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.defaultTTL.Store(int64(d))
+}
+
+// OnNamespaceCreate registers fn to be called with the namespace after a
+// cache is created. Hooks run without the store lock held, in the order
+// they were registered.
+func (s *Store) OnNamespaceCreate(fn func(namespace string)) {
+	if s == nil || fn == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.onCreate = append(s.onCreate, fn)
+}
+
+// OnNamespaceRemove registers fn to be called with the namespace after it
+// is removed from the store, whether by Remove, RemoveEmpty or a sweep.
+// Hooks run without the store lock held, in the order they were
+// registered.
+func (s *Store) OnNamespaceRemove(fn func(namespace string)) {
+	if s == nil || fn == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.onRemove = append(s.onRemove, fn)
+}
+
+// notify calls every hook with namespace
+func notify(hooks []func(namespace string), namespace string) {
+	for _, fn := range hooks {
+		fn(namespace)
+	}
+}
+
 func (s *Store) Namespaces() []string {
 	if s == nil {
 		return nil
 	}
 	var namespaces []string
 
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	for k := range s.data {
 		namespaces = append(namespaces, k)
@@ -66,14 +396,231 @@ func (s *Store) Size() int {
 	return len(s.Namespaces())
 }
 
+// Keys returns every unexpired key in the store qualified by its
+// namespace, as namespace + separator + key, sorted
+func (s *Store) Keys(separator string) []string {
+	if s == nil {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	var keys []string
+	for namespace, cache := range s.data {
+		now := cache.now()
+		cache.storage.Range(func(key, value any) bool {
+			if !value.(*entry).expired(now) {
+				keys = append(keys, namespace+separator+key.(string))
+			}
+			return true
+		})
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Walk calls fn for every unexpired entry in the store, visiting namespaces
+// in sorted order, and stops early if fn returns false. The set of
+// namespaces is captured up front so fn runs without the store lock held
+// and may itself use the store. Values are decoded; one that fails to
+// decode is logged and skipped.
+func (s *Store) Walk(fn func(namespace, key string, value any) bool) {
+	if s == nil {
+		return
+	}
+
+	s.RLock()
+	caches := make(map[string]*Cache, len(s.data))
+	for namespace, cache := range s.data {
+		caches[namespace] = cache
+	}
+	s.RUnlock()
+
+	namespaces := make([]string, 0, len(caches))
+	for namespace := range caches {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		cache := caches[namespace]
+		now := cache.now()
+		stopped := false
+		cache.storage.Range(func(key, value any) bool {
+			e := value.(*entry)
+			if e.expired(now) {
+				return true
+			}
+			decoded, err := cache.load(e.value)
+			if err != nil {
+				logAt(s.logger, slog.LevelError, "decode failed", "namespace", namespace, "key", key, "error", err)
+				return true
+			}
+			if !fn(namespace, key.(string), decoded) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// NamespaceSize is a namespace and the number of entries in its cache
+type NamespaceSize struct {
+	Namespace string
+	Entries   int
+}
+
+// NamespacesBySize returns every namespace with its entry count, largest
+// first. Namespaces of equal size are ordered by name. Counts are taken
+// with the store locked so the set of namespaces is consistent.
+func (s *Store) NamespacesBySize() []NamespaceSize {
+	if s == nil {
+		return nil
+	}
+
+	s.RLock()
+	sizes := make([]NamespaceSize, 0, len(s.data))
+	for namespace, cache := range s.data {
+		sizes = append(sizes, NamespaceSize{Namespace: namespace, Entries: cache.Size()})
+	}
+	s.RUnlock()
+
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Entries != sizes[j].Entries {
+			return sizes[i].Entries > sizes[j].Entries
+		}
+		return sizes[i].Namespace < sizes[j].Namespace
+	})
+	return sizes
+}
+
+// SetNamespaceLabels replaces the labels on a namespace, e.g. tier=hot,
+// for selecting caches with NamespacesWithLabel. A nil or empty map clears
+// them.
+func (s *Store) SetNamespaceLabels(namespace string, labels map[string]string) error {
+	if s == nil {
+		return nilStore(namespace)
+	}
+	namespace = s.normalize(namespace)
+
+	s.RLock()
+	cache, exists := s.data[namespace]
+	s.RUnlock()
+	if !exists {
+		return namespaceNotFound(namespace)
+	}
+
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	cache.mu.Lock()
+	cache.labels = copied
+	cache.mu.Unlock()
+	return nil
+}
+
+// NamespacesWithLabel returns the namespaces labeled key=value, sorted
+func (s *Store) NamespacesWithLabel(key, value string) []string {
+	if s == nil {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	var namespaces []string
+	for namespace, cache := range s.data {
+		if cache.hasLabel(key, value) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// TTLRemaining returns the time left before each namespace expires
+func (s *Store) TTLRemaining() map[string]time.Duration {
+	if s == nil {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	remaining := make(map[string]time.Duration, len(s.data))
+	for namespace, cache := range s.data {
+		ttl := cache.expiry().Sub(s.clock.Now())
+		if ttl < 0 {
+			ttl = 0
+		}
+		remaining[namespace] = ttl
+	}
+	return remaining
+}
+
+// TTLHistogram counts namespaces by remaining TTL. Each bucket is an upper
+// bound: a namespace is counted in the smallest bucket that is greater than
+// or equal to its remaining TTL. Namespaces with more time left than the
+// largest bucket are not counted.
+func (s *Store) TTLHistogram(buckets []time.Duration) map[time.Duration]int {
+	bounds := make([]time.Duration, len(buckets))
+	copy(bounds, buckets)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	histogram := make(map[time.Duration]int, len(bounds))
+	for _, bound := range bounds {
+		histogram[bound] = 0
+	}
+	for _, ttl := range s.TTLRemaining() {
+		i := sort.Search(len(bounds), func(i int) bool { return bounds[i] >= ttl })
+		if i < len(bounds) {
+			histogram[bounds[i]]++
+		}
+	}
+	return histogram
+}
+
+// Has reports whether the given namespace exists in the store. An expired
+// namespace is expired on the spot, as a sweep would, so Has is accurate
+// without a janitor running.
+func (s *Store) Has(namespace string) bool {
+	if s == nil {
+		return false
+	}
+	namespace = s.normalize(namespace)
+
+	s.RLock()
+	cache, exists := s.data[namespace]
+	s.RUnlock()
+
+	if !exists || cache == nil || !s.isDue(cache) {
+		return exists
+	}
+	if s.expireNamespace(namespace, cache) {
+		return s.expirePolicy == EmptyNamespace
+	}
+	// the namespace changed after it was checked; report it as it is now
+	s.RLock()
+	_, exists = s.data[namespace]
+	s.RUnlock()
+	return exists
+}
+
 // UseNamespace returns a cache within the given namespace
 func (s *Store) UseNamespace(namespace string) (*Cache, error) {
 	if s == nil {
 		return nil, nilCache(namespace)
 	}
+	namespace = s.normalize(namespace)
 
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	if s.data[namespace] == nil {
 		return nil, fmt.Errorf("cache with %s namespace does not exist", namespace)
@@ -81,40 +628,457 @@ func (s *Store) UseNamespace(namespace string) (*Cache, error) {
 	return s.data[namespace], nil
 }
 
+// MustUse is like UseNamespace but panics if the namespace does not exist.
+// It is intended for setup code where a missing namespace is a programming
+// error.
+func (s *Store) MustUse(namespace string) *Cache {
+	cache, err := s.UseNamespace(namespace)
+	if err != nil {
+		panic("cch: MustUse(" + namespace + "): " + err.Error())
+	}
+	return cache
+}
+
 func (s *Store) Remove(namespace string) error {
+	if s == nil {
+		return nilStore(namespace)
+	}
+	namespace = s.normalize(namespace)
+
 	s.Lock()
-	defer s.Unlock()
+	cache, exists := s.data[namespace]
+	if !exists {
+		s.Unlock()
+		return namespaceNotFound(namespace)
+	}
+
+	delete(s.data, namespace)
+	s.expiries.remove(cache)
+	s.watchers.publish(NamespaceEvent{Namespace: namespace, Kind: Removed})
+	hooks := s.onRemove
+	s.Unlock()
+
+	logAt(s.logger, slog.LevelDebug, "cache removed", "store", s.id, "namespace", namespace)
+	notify(hooks, namespace)
 
+	return nil
+}
+
+// PurgeNamespace clears every entry from a namespace but, unlike Remove,
+// keeps it registered along with its expiry and labels
+func (s *Store) PurgeNamespace(namespace string) error {
 	if s == nil {
 		return nilStore(namespace)
 	}
+	namespace = s.normalize(namespace)
 
-	if _, exists := s.data[namespace]; !exists {
+	s.RLock()
+	cache, exists := s.data[namespace]
+	s.RUnlock()
+	if !exists {
 		return namespaceNotFound(namespace)
 	}
+	cache.Purge()
+	logAt(s.logger, slog.LevelDebug, "cache purged", "store", s.id, "namespace", namespace)
 
-	delete(s.data, namespace)
+	return nil
+}
+
+// DrainNamespace stops a namespace from accepting writes while reads keep
+// working. Writes to a draining cache return ErrDraining; call Remove to
+// finish tearing it down.
+func (s *Store) DrainNamespace(namespace string) error {
+	if s == nil {
+		return nilStore(namespace)
+	}
+	namespace = s.normalize(namespace)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	cache, exists := s.data[namespace]
+	if !exists {
+		return namespaceNotFound(namespace)
+	}
+	cache.draining.Store(true)
+	logAt(s.logger, slog.LevelDebug, "cache draining", "store", s.id, "namespace", namespace)
 
 	return nil
 }
 
-func (s *Store) ExpireCache() error {
-	for _, namespace := range s.Namespaces() {
-		cache, err := s.UseNamespace(namespace)
+// Rebalance moves entries between namespaces. route is called for every
+// entry and returns the namespace the entry belongs in; entries already in
+// their target are left alone. Missing target namespaces are created with
+// the source namespace's expiry. An entry is only removed from its source
+// once it has been added to its target, and a key that already exists in
+// the target is reported as an error rather than overwritten. An entry
+// written to again while it is being moved stays in its source.
+func (s *Store) Rebalance(route func(namespace, key string, value any) string) error {
+	if s == nil {
+		return nilStore("")
+	}
+
+	var errs []error
+	snap := s.Snapshot()
+	for namespace, cs := range snap.caches {
+		source, err := s.UseNamespace(namespace)
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
-		if isCacheExpired(cache) {
-			if err := s.Remove(namespace); err != nil {
-				return err
+		for key := range cs.entries {
+			read, exists := source.storage.Load(key)
+			if !exists {
+				continue
+			}
+			e := read.(*entry)
+			value, err := source.load(e.value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("moving %s from %s: %w", key, namespace, err))
+				continue
+			}
+			target := s.normalize(route(namespace, key, value))
+			if target == namespace {
+				continue
+			}
+			dest, err := s.useOrCreate(target, cs.expire)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			stored, err := dest.encodeValue(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("moving %s from %s to %s: %w", key, namespace, target, err))
+				continue
+			}
+			moved := newEntry(stored, e.expires, e.written, e.accessed())
+			if err := dest.add(key, moved); err != nil {
+				errs = append(errs, fmt.Errorf("moving %s from %s to %s: %w", key, namespace, target, err))
+				continue
+			}
+			if !source.storage.CompareAndDelete(key, read) {
+				// written to since it was read; keep the newer value
+				// in the source and take the copy back out
+				dest.storage.CompareAndDelete(key, moved)
+				logAt(s.logger, slog.LevelDebug, "rebalance skipped changed key", "store", s.id, "namespace", namespace, "key", key)
 			}
 		}
 	}
-	return nil
+	return errors.Join(errs...)
+}
+
+// useOrCreate returns the cache for namespace, creating it with the given
+// absolute expiry if it does not exist. Concurrent calls for the same
+// missing namespace create it once.
+func (s *Store) useOrCreate(namespace string, expire time.Time) (*Cache, error) {
+	namespace = s.normalize(namespace)
+	lookup := func() (*Cache, bool) {
+		s.RLock()
+		defer s.RUnlock()
+		cache, exists := s.data[namespace]
+		return cache, exists
+	}
+	if cache, exists := lookup(); exists {
+		return cache, nil
+	}
+	created, err := s.creates.do(namespace, func() (any, error) {
+		if cache, exists := lookup(); exists {
+			return cache, nil
+		}
+		return s.newCacheUntil(namespace, expire)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created.(*Cache), nil
+}
+
+// newCacheUntil creates a cache in namespace that expires at expire. Its
+// TTL is the time left until then, so a renewal under EmptyNamespace gives
+// it the same lifetime again instead of renewing it to now.
+func (s *Store) newCacheUntil(namespace string, expire time.Time) (*Cache, error) {
+	cache, err := s.NewCache(namespace, expire.Sub(s.clock.Now()))
+	if err != nil {
+		return nil, err
+	}
+	cache.SetExpiry(expire)
+	return cache, nil
+}
+
+// Load returns the value at key in namespace, creating the namespace if it
+// does not exist. On a miss it calls loader and caches the result for ttl
+// before returning it; concurrent misses on the same key share a single
+// loader call. A new namespace lives for ttl as well. Loader errors are
+// returned and nothing is cached.
+func (s *Store) Load(namespace, key string, ttl time.Duration, loader func() (any, error)) (any, error) {
+	if s == nil {
+		return nil, nilStore(namespace)
+	}
+	cache, err := s.useOrCreate(namespace, s.clock.Now().Add(ttl))
+	if err != nil {
+		return nil, err
+	}
+	if value, exists := cache.Get(key); exists {
+		return value, nil
+	}
+	return s.loads.do(cache.namespace+"\x00"+key, func() (any, error) {
+		if value, exists := cache.Peek(key); exists {
+			return value, nil
+		}
+		value, err := loader()
+		if err != nil {
+			return nil, err
+		}
+		if err := cache.SetMany(map[string]ItemWithTTL{key: {Value: value, TTL: ttl}}); err != nil {
+			return nil, err
+		}
+		return value, nil
+	})
+}
+
+// RemoveEmpty removes every namespace whose cache is empty and returns the
+// number of namespaces removed. Each cache is checked again under the store
+// lock before it is removed, so one that gained entries is kept.
+func (s *Store) RemoveEmpty() int {
+	return s.RemoveWhere(func(namespace string, c *Cache) bool {
+		return c.Size() == 0
+	})
+}
+
+// RemoveWhere removes every namespace for which pred returns true and
+// returns the number of namespaces removed. pred is first called on a
+// snapshot of the namespaces without the store lock held, then again for
+// each match with the lock held just before it is removed, so a namespace
+// that stopped matching, or whose cache was replaced, in the meantime is
+// left alone. pred must not call back into the store.
+func (s *Store) RemoveWhere(pred func(namespace string, c *Cache) bool) int {
+	if s == nil || pred == nil {
+		return 0
+	}
+
+	s.RLock()
+	caches := make(map[string]*Cache, len(s.data))
+	for namespace, cache := range s.data {
+		caches[namespace] = cache
+	}
+	s.RUnlock()
+
+	matched := make(map[string]*Cache)
+	for namespace, cache := range caches {
+		if pred(namespace, cache) {
+			matched[namespace] = cache
+		}
+	}
+	if len(matched) == 0 {
+		return 0
+	}
+
+	s.Lock()
+	var removed []string
+	for namespace, cache := range matched {
+		if s.data[namespace] == cache && pred(namespace, cache) {
+			delete(s.data, namespace)
+			s.expiries.remove(cache)
+			removed = append(removed, namespace)
+		}
+	}
+	sort.Strings(removed)
+	for _, namespace := range removed {
+		s.watchers.publish(NamespaceEvent{Namespace: namespace, Kind: Removed})
+	}
+	hooks := s.onRemove
+	s.Unlock()
+
+	for _, namespace := range removed {
+		logAt(s.logger, slog.LevelDebug, "cache removed", "store", s.id, "namespace", namespace)
+		notify(hooks, namespace)
+	}
+	return len(removed)
+}
+
+// Compact rebuilds the storage of every namespace so that it holds only
+// unexpired entries, letting the memory retained by removed keys be
+// reclaimed. Reads continue during compaction; writes to a namespace wait
+// while it is being rebuilt.
+func (s *Store) Compact() {
+	if s == nil {
+		return
+	}
+
+	s.RLock()
+	caches := make([]*Cache, 0, len(s.data))
+	for _, cache := range s.data {
+		caches = append(caches, cache)
+	}
+	s.RUnlock()
+
+	for _, cache := range caches {
+		now := cache.now()
+		n := cache.storage.compact(func(e *entry) bool {
+			return !e.expired(now)
+		})
+		logAt(s.logger, slog.LevelDebug, "cache compacted", "store", s.id, "namespace", cache.namespace, "entries", n)
+	}
+}
+
+func (s *Store) ExpireCache() error {
+	_, err := s.Sweep()
+	return err
+}
+
+// Sweep removes every expired cache from the store, or empties and renews
+// it under the EmptyNamespace policy, and returns the number of namespaces
+// expired during the pass. Only namespaces whose deadline has passed are
+// visited. A failure on one namespace does not stop the sweep; all
+// failures are joined into the returned error. Caches with a memory
+// pressure threshold then shed entries if the heap is above it.
+func (s *Store) Sweep() (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	removed := 0
+	var errs []error
+	for _, item := range s.expiries.due(s.clock.Now()) {
+		namespace, cache := item.namespace, item.cache
+		s.RLock()
+		current, exists := s.data[namespace]
+		s.RUnlock()
+		if !exists || current != cache {
+			// the namespace was removed, or recreated after a handle to
+			// the old cache set its expiry; nothing to sweep
+			continue
+		}
+		if cache == nil {
+			err := nilCache(namespace)
+			logAt(s.logger, slog.LevelError, "sweep failed", "store", s.id, "namespace", namespace, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		if !s.isDue(cache) {
+			// past its deadline but still holding entries under
+			// DeleteNamespace; check it again next sweep
+			s.expiries.set(namespace, cache, cache.expiry())
+			continue
+		}
+		if s.expireNamespace(namespace, cache) {
+			removed++
+		}
+	}
+	s.shedUnderPressure()
+	return removed, errors.Join(errs...)
+}
+
+// shedUnderPressure has every cache with a memory pressure threshold shed
+// entries if the heap is above it. Memory stats are only read when some
+// cache has a threshold.
+func (s *Store) shedUnderPressure() {
+	s.RLock()
+	var caches []*Cache
+	for _, cache := range s.data {
+		if cache != nil && cache.pressureLimit.Load() > 0 {
+			caches = append(caches, cache)
+		}
+	}
+	s.RUnlock()
+	if len(caches) == 0 {
+		return
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	for _, cache := range caches {
+		if n := cache.shed(stats.HeapAlloc); n > 0 {
+			logAt(s.logger, slog.LevelInfo, "cache shed entries", "store", s.id, "namespace", cache.namespace, "entries", n, "heap", stats.HeapAlloc)
+		}
+	}
+}
+
+// expireNamespace removes the expired cache at namespace, or empties and
+// renews it under the EmptyNamespace policy, and reports whether it did. A
+// namespace that no longer holds cache is left alone.
+func (s *Store) expireNamespace(namespace string, cache *Cache) bool {
+	if s.expirePolicy == EmptyNamespace {
+		cache.Purge()
+		cache.renew()
+		logAt(s.logger, slog.LevelInfo, "cache renewed", "store", s.id, "namespace", namespace)
+		return true
+	}
+	if !s.removeCache(namespace, cache) {
+		return false
+	}
+	logAt(s.logger, slog.LevelInfo, "cache expired", "store", s.id, "namespace", namespace)
+	return true
+}
+
+// removeCache removes namespace if it still holds cache, checking under the
+// store lock, and reports whether it did
+func (s *Store) removeCache(namespace string, cache *Cache) bool {
+	s.Lock()
+	if s.data[namespace] != cache {
+		s.Unlock()
+		return false
+	}
+	delete(s.data, namespace)
+	s.expiries.remove(cache)
+	s.watchers.publish(NamespaceEvent{Namespace: namespace, Kind: Removed})
+	hooks := s.onRemove
+	s.Unlock()
+
+	logAt(s.logger, slog.LevelDebug, "cache removed", "store", s.id, "namespace", namespace)
+	notify(hooks, namespace)
+	return true
+}
+
+// WalkExpired calls fn for every cache that the next sweep would remove, or
+// purge and renew under EmptyNamespace, without touching it. fn is called
+// without the store lock held.
+func (s *Store) WalkExpired(fn func(namespace string, c *Cache)) {
+	if s == nil {
+		return
+	}
+
+	s.RLock()
+	caches := make(map[string]*Cache, len(s.data))
+	for namespace, cache := range s.data {
+		caches[namespace] = cache
+	}
+	s.RUnlock()
+
+	for namespace, cache := range caches {
+		if s.isDue(cache) {
+			fn(namespace, cache)
+		}
+	}
 }
 
 func isCacheExpired(cache *Cache) bool {
-	return cache.expire.After(time.Now()) && cache.Size() == 0
+	return !cache.expiry().After(cache.now()) && cache.Size() == 0
+}
+
+// isDue reports whether a sweep should act on cache. Under DeleteNamespace
+// a namespace is only removed once it is past its deadline and empty;
+// under EmptyNamespace any cache past its deadline is purged and renewed.
+func (s *Store) isDue(cache *Cache) bool {
+	if s.expirePolicy == EmptyNamespace {
+		return !cache.expiry().After(cache.now())
+	}
+	return isCacheExpired(cache)
+}
+
+// normalize applies the store's namespace normalizer, if any
+func (s *Store) normalize(namespace string) string {
+	if s.normalizer == nil {
+		return namespace
+	}
+	return s.normalizer(namespace)
+}
+
+// logAt logs msg at the given level when a logger is configured
+func logAt(logger *slog.Logger, level slog.Level, msg string, args ...any) {
+	if logger == nil {
+		return
+	}
+	logger.Log(context.Background(), level, msg, args...)
 }
 
 func nilStore(namespace string) error {
@@ -0,0 +1,113 @@
+package cch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// streamRecord is one line of a StreamJSON stream. Kind is "store" for the
+// header line, "namespace" for each cache, and "entry" for each key.
+type streamRecord struct {
+	Kind      string     `json:"kind"`
+	ID        string     `json:"id,omitempty"`
+	Namespace string     `json:"namespace,omitempty"`
+	Expire    *time.Time `json:"expire,omitempty"`
+	Key       string     `json:"key,omitempty"`
+	Value     any        `json:"value,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// StreamJSON writes the store to w as newline-delimited JSON, one record
+// per namespace and per unexpired entry, in sorted namespace and key order
+// so the output is reproducible
+func (s *Store) StreamJSON(w io.Writer) error {
+	if s == nil {
+		return nilStore("")
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(streamRecord{Kind: "store", ID: s.id}); err != nil {
+		return err
+	}
+
+	for _, namespace := range s.Namespaces() {
+		cache, err := s.UseNamespace(namespace)
+		if err != nil {
+			continue
+		}
+		expire := cache.expiry()
+		if err := enc.Encode(streamRecord{Kind: "namespace", Namespace: namespace, Expire: &expire}); err != nil {
+			return err
+		}
+
+		for _, e := range cache.storedEntries() {
+			decoded, err := cache.load(e.Value)
+			if err != nil {
+				return fmt.Errorf("decoding %s/%s: %w", namespace, e.Key, err)
+			}
+			rec := streamRecord{Kind: "entry", Namespace: namespace, Key: e.Key, Value: decoded}
+			if !e.ExpiresAt.IsZero() {
+				expires := e.ExpiresAt
+				rec.Expires = &expires
+			}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StreamLoad reads a store written by StreamJSON from r. Values are decoded
+// with encoding/json, so numbers come back as float64.
+func StreamLoad(r io.Reader) (*Store, error) {
+	dec := json.NewDecoder(r)
+
+	var header streamRecord
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Kind != "store" {
+		return nil, fmt.Errorf("expected store record but got %q", header.Kind)
+	}
+
+	store := NewStore(header.ID)
+	for {
+		var rec streamRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return store, nil
+			}
+			return nil, err
+		}
+
+		switch rec.Kind {
+		case "namespace":
+			var err error
+			if rec.Expire != nil {
+				_, err = store.newCacheUntil(rec.Namespace, *rec.Expire)
+			} else {
+				_, err = store.NewCache(rec.Namespace, 0)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case "entry":
+			cache, err := store.UseNamespace(rec.Namespace)
+			if err != nil {
+				return nil, err
+			}
+			var expires time.Time
+			if rec.Expires != nil {
+				expires = *rec.Expires
+			}
+			now := cache.now()
+			cache.storage.Store(rec.Key, newEntry(rec.Value, expires, now, now))
+		default:
+			return nil, fmt.Errorf("unknown record kind %q", rec.Kind)
+		}
+	}
+}
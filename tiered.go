@@ -0,0 +1,79 @@
+package cch
+
+// TieredStore puts a small hot cache in front of a larger cold one.
+//
+// Writes go to the cold tier only and invalidate any copy held by the hot
+// tier. Reads check the hot tier first and fall back to the cold tier,
+// promoting the value into the hot tier on a cold hit. When the hot tier
+// holds hotLimit entries, an arbitrary hot entry is evicted to make room
+// for the promotion; evicted entries remain in the cold tier.
+type TieredStore struct {
+	hot      *Cache
+	cold     *Cache
+	hotLimit int
+}
+
+// NewTieredStore creates a tiered store over the given hot and cold caches.
+// A hotLimit of zero or less leaves the hot tier unbounded.
+func NewTieredStore(hot, cold *Cache, hotLimit int) *TieredStore {
+	return &TieredStore{
+		hot:      hot,
+		cold:     cold,
+		hotLimit: hotLimit,
+	}
+}
+
+// Set writes the value to the cold tier and drops any hot copy
+func (ts *TieredStore) Set(key string, value any) error {
+	if err := ts.cold.AddWith(key, value, Overwrite); err != nil {
+		return err
+	}
+	ts.hot.storage.Delete(key)
+	return nil
+}
+
+// Get gets an item by key from the hot tier, or from the cold tier while
+// promoting it into the hot tier. A promoted entry keeps the cold entry's
+// deadline.
+func (ts *TieredStore) Get(key string) (any, bool) {
+	if value, exists := ts.hot.Get(key); exists {
+		return value, true
+	}
+	read, _ := ts.cold.storage.Load(key)
+	value, exists := ts.cold.Get(key)
+	if !exists {
+		return nil, false
+	}
+	if read != nil {
+		ts.promote(key, value, read.(*entry))
+	}
+	return value, true
+}
+
+// Remove removes an item from both tiers
+func (ts *TieredStore) Remove(key string) error {
+	ts.hot.storage.Delete(key)
+	return ts.cold.Remove(key)
+}
+
+// promote copies the cold entry read into the hot tier. A Set that lands
+// after read was loaded has already dropped the hot copy, so the promotion
+// is undone if the cold tier no longer holds read.
+func (ts *TieredStore) promote(key string, value any, read *entry) {
+	stored, err := ts.hot.encodeValue(value)
+	if err != nil {
+		return
+	}
+	if ts.hotLimit > 0 && ts.hot.Size() >= ts.hotLimit {
+		ts.hot.storage.Range(func(k, _ any) bool {
+			ts.hot.storage.Delete(k)
+			return false
+		})
+	}
+	ts.hot.remember(key)
+	promoted := newEntry(stored, read.expires, read.written, ts.hot.now())
+	ts.hot.storage.Store(key, promoted)
+	if current, _ := ts.cold.storage.Load(key); current != read {
+		ts.hot.storage.CompareAndDelete(key, promoted)
+	}
+}
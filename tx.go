@@ -0,0 +1,214 @@
+package cch
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Tx buffers writes across namespaces for Store.Transaction. Reads through
+// a Tx see its own buffered writes. A Tx must not be used after the
+// transaction function returns.
+type Tx struct {
+	store  *Store
+	caches map[string]*Cache
+	writes map[string]map[string]*txWrite
+}
+
+// txWrite is the buffered state of one key. value is what the transaction
+// reads and stored is the form it is written in. read is the entry the
+// transaction first saw, nil if the key was absent; commit fails if the
+// key no longer holds it.
+type txWrite struct {
+	value   any
+	stored  any
+	removed bool
+	read    *entry
+	op      string
+}
+
+// Transaction calls fn with a Tx and, if fn returns nil, applies every
+// write it buffered as a unit. If fn returns an error, or another writer
+// has since added or removed a key the transaction touched, nothing is
+// applied and the error is returned. Writers to the affected namespaces
+// are blocked while the transaction is applied.
+func (s *Store) Transaction(fn func(tx *Tx) error) error {
+	if s == nil {
+		return nilStore("")
+	}
+	tx := &Tx{
+		store:  s,
+		caches: make(map[string]*Cache),
+		writes: make(map[string]map[string]*txWrite),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Get returns the value at key in namespace, including writes buffered by
+// the transaction
+func (tx *Tx) Get(namespace, key string) (any, bool) {
+	namespace = tx.store.normalize(namespace)
+	w, err := tx.load(namespace, key)
+	if err != nil || w.removed {
+		return nil, false
+	}
+	return w.value, true
+}
+
+// Add buffers adding key to namespace. It returns an error if the key
+// already exists.
+func (tx *Tx) Add(namespace, key string, value any) error {
+	namespace = tx.store.normalize(namespace)
+	w, err := tx.load(namespace, key)
+	if err != nil {
+		return err
+	}
+	if !w.removed {
+		return fmt.Errorf("key already exists: %s", key)
+	}
+	stored, err := tx.caches[namespace].prepare(value)
+	if err != nil {
+		return err
+	}
+	w.value, w.stored, w.removed, w.op = value, stored, false, "add"
+	return nil
+}
+
+// Replace buffers replacing the value at key in namespace. It returns an
+// error if the key does not exist.
+func (tx *Tx) Replace(namespace, key string, value any) error {
+	namespace = tx.store.normalize(namespace)
+	w, err := tx.load(namespace, key)
+	if err != nil {
+		return err
+	}
+	if w.removed {
+		return keyNotExists(key, namespace)
+	}
+	stored, err := tx.caches[namespace].prepare(value)
+	if err != nil {
+		return err
+	}
+	w.value, w.stored, w.op = value, stored, "replace"
+	return nil
+}
+
+// Remove buffers removing key from namespace. It returns an error if the
+// key does not exist.
+func (tx *Tx) Remove(namespace, key string) error {
+	namespace = tx.store.normalize(namespace)
+	w, err := tx.load(namespace, key)
+	if err != nil {
+		return err
+	}
+	if w.removed {
+		return keyNotExists(key, namespace)
+	}
+	w.value, w.stored, w.removed, w.op = nil, nil, true, "remove"
+	return nil
+}
+
+// load returns the buffered state of key, reading it from the cache the
+// first time the transaction touches it. namespace must already be
+// normalized.
+func (tx *Tx) load(namespace, key string) (*txWrite, error) {
+	if w, exists := tx.writes[namespace][key]; exists {
+		return w, nil
+	}
+	cache, exists := tx.caches[namespace]
+	if !exists {
+		var err error
+		if cache, err = tx.store.UseNamespace(namespace); err != nil {
+			return nil, err
+		}
+		tx.caches[namespace] = cache
+		tx.writes[namespace] = make(map[string]*txWrite)
+	}
+	w := &txWrite{removed: true}
+	if value, exists := cache.storage.Load(key); exists {
+		w.read = value.(*entry)
+	}
+	if w.read != nil && !w.read.expired(cache.now()) {
+		decoded, err := cache.load(w.read.value)
+		if err != nil {
+			return nil, err
+		}
+		w.value, w.stored, w.removed = decoded, w.read.value, false
+	}
+	tx.writes[namespace][key] = w
+	return w, nil
+}
+
+// commit applies the buffered writes, then reports them to each cache's
+// audit hook and subscribers once no locks are held
+func (tx *Tx) commit() error {
+	namespaces := make([]string, 0, len(tx.writes))
+	for namespace := range tx.writes {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	if err := tx.apply(namespaces); err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		cache := tx.caches[namespace]
+		for key, w := range tx.writes[namespace] {
+			if w.op == "" {
+				continue
+			}
+			cache.audit(w.op, key)
+			if !w.removed {
+				cache.publish(key, w.stored)
+			}
+		}
+	}
+	return nil
+}
+
+// apply writes every buffered change with the affected namespaces locked
+// against other writers, after checking that no key the transaction read
+// has changed. Namespaces are locked in sorted order so concurrent
+// transactions cannot deadlock.
+func (tx *Tx) apply(namespaces []string) error {
+	for _, namespace := range namespaces {
+		em := tx.caches[namespace].storage
+		em.mu.Lock()
+		defer em.mu.Unlock()
+	}
+
+	for _, namespace := range namespaces {
+		cache := tx.caches[namespace]
+		if err := cache.writable(); err != nil {
+			return err
+		}
+		m := cache.storage.m.Load()
+		for key, w := range tx.writes[namespace] {
+			current, _ := m.Load(key)
+			if e, _ := current.(*entry); e != w.read {
+				return fmt.Errorf("key changed during transaction: %s", key)
+			}
+		}
+	}
+
+	for _, namespace := range namespaces {
+		cache := tx.caches[namespace]
+		m := cache.storage.m.Load()
+		now := cache.now()
+		for key, w := range tx.writes[namespace] {
+			switch {
+			case w.op == "":
+			case w.removed:
+				m.Delete(key)
+			case w.read == nil || w.read.expired(now):
+				cache.remember(key)
+				m.Store(key, newEntry(w.stored, cache.defaultDeadline(now), now, now))
+			default:
+				m.Store(key, newEntry(w.stored, w.read.expires, now, now))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package cch
+
+import (
+	"fmt"
+	"time"
+)
+
+// TypedCache wraps a Cache whose values are all of type T
+type TypedCache[T any] struct {
+	cache *Cache
+}
+
+// NewTypedCache creates a new cache in the given namespace holding values of type T
+func NewTypedCache[T any](s *Store, namespace string, expire time.Duration) (*TypedCache[T], error) {
+	cache, err := s.NewCache(namespace, expire)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedCache[T]{cache: cache}, nil
+}
+
+// NewIntCache creates a new cache of int values in the given namespace
+func (s *Store) NewIntCache(namespace string, expire time.Duration) (*TypedCache[int], error) {
+	return NewTypedCache[int](s, namespace, expire)
+}
+
+// NewStringCache creates a new cache of string values in the given namespace
+func (s *Store) NewStringCache(namespace string, expire time.Duration) (*TypedCache[string], error) {
+	return NewTypedCache[string](s, namespace, expire)
+}
+
+// NewBytesCache creates a new cache of []byte values in the given namespace
+func (s *Store) NewBytesCache(namespace string, expire time.Duration) (*TypedCache[[]byte], error) {
+	return NewTypedCache[[]byte](s, namespace, expire)
+}
+
+// Add adds a new item to the cache
+func (tc *TypedCache[T]) Add(key string, value T) error {
+	return tc.cache.Add(key, value)
+}
+
+// Get gets an item from the cache by key, returning an error if the key
+// does not exist or its value is not of type T
+func (tc *TypedCache[T]) Get(key string) (T, error) {
+	var zero T
+	value, exists := tc.cache.Get(key)
+	if !exists {
+		return zero, keyNotExists(key, tc.cache.namespace)
+	}
+	typed, ok := value.(T)
+	if !ok {
+		return zero, fmt.Errorf("value for key %s is %T, not %T", key, value, zero)
+	}
+	return typed, nil
+}
+
+// Replace removes the value and replaces it with a new one
+func (tc *TypedCache[T]) Replace(key string, value T) error {
+	return tc.cache.Replace(key, value)
+}
+
+// Remove removes an item from the cache
+func (tc *TypedCache[T]) Remove(key string) error {
+	return tc.cache.Remove(key)
+}
+
+// Cache returns the underlying untyped cache
+func (tc *TypedCache[T]) Cache() *Cache {
+	return tc.cache
+}